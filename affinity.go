@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+)
+
+const defaultAffinityCookie string = "QEDGEPROXY_AFFINITY"
+
+// getAffinityKey returns the key a request is consistently hashed with, chosen by the affinity annotation
+// of the service: cookie, header (named by affinityHeader) or source-ip, an empty key disables affinity
+func getAffinityKey(rw http.ResponseWriter, req *http.Request, namespace string, service string) string {
+	switch edgeBalancer.GetServiceAnnotation(namespace, service, "affinity") {
+	case "cookie":
+		cookieName := edgeBalancer.GetServiceAnnotation(namespace, service, "affinityCookie")
+		if cookieName == "" {
+			cookieName = defaultAffinityCookie
+		}
+
+		if cookie, err := req.Cookie(cookieName); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+
+		// first request of a session, the new key is handed to the client with the response
+		key, err := newAffinityKey()
+		if err != nil {
+			log.Println("Failed to create affinity key ::", err)
+			return ""
+		}
+		http.SetCookie(rw, &http.Cookie{Name: cookieName, Value: key, Path: "/", HttpOnly: true})
+		return key
+	case "header":
+		return req.Header.Get(edgeBalancer.GetServiceAnnotation(namespace, service, "affinityHeader"))
+	case "source-ip":
+		return getSourceIP(req)
+	}
+
+	return ""
+}
+
+func getSourceIP(req *http.Request) string {
+	if sourceIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return sourceIP
+	}
+
+	return req.RemoteAddr
+}
+
+func newAffinityKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key), nil
+}
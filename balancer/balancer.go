@@ -1,16 +1,18 @@
 package balancer
 
 import (
-	"io/ioutil"
+	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
-	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/robfig/cron/v3"
 	client "gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/k3s-client"
 	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
 )
@@ -25,8 +27,10 @@ const defaultPingCacheTime int = 100
 const defaultQosRecalculationCooldownS = 60
 const defaultNewLatencyApprWeight float64 = 0.7
 const defaultMaxUsage float64 = 0.95
+const defaultMaxQueueDepth int = 0
+const defaultAffinityTTLS int = 600
 
-const pingURLSuffix string = "/echo?param1=value1&param2=value2"
+const pingURLSuffix string = "/probe"
 
 type Balancer struct {
 	ownIP     string
@@ -36,28 +40,76 @@ type Balancer struct {
 	qosRecalculationTime      map[string]time.Time
 	qosRecalculationCooldownS int
 
-	maxResUsage float64
+	maxResUsage   float64
+	maxQueueDepth int
 
 	latencyWeight         float64
 	latencyApprWeight     float64
 	realDataPeriodS       int
 	cooldownBaseDurationS int
 
+	breakerWindow           int
+	breakerMinRequests      int
+	breakerFailureRate      float64
+	breakerMaxOpenS         int
+	breakerHalfOpenRequests int
+	breakers                map[string]*circuitBreaker
+	breakerMutex            *sync.Mutex
+
+	outlierBaseEjectionS   int
+	outlierMaxEjectionPerc float64
+	outlierMinRequests     int
+	outlierStdevFactor     float64
+	outlierLatencyFactor   float64
+	outlierStats           map[string]map[string]*outlierStats
+	ejections              map[string]map[string]*outlierEjection
+	outlierMutex           *sync.Mutex
+
+	stateFile    string
+	stateMaxAgeS int
+	scheduler    *cron.Cron
+
+	// stateMutex guards the latency state, hostLatency and hostPingCache, and the per-service maps
+	stateMutex *sync.Mutex
+
 	pingPort      string
+	probeToken    string
 	pingTimeout   int
 	pingCacheTime int
 	hostPingCache map[string]*model.PingCache
 
-	randomMode bool
+	strategy     string
+	scoreWeights map[string]float64
 
 	serviceInit   map[string]bool
 	hostLatency   map[string]map[string]*model.HostData
 	maxLatencies  map[string]int
 	channels      map[string]chan map[string]*model.HostData
 	approxRunning map[string]*atomic.Bool
+
+	localityWeights map[string]float64
+
+	inFlight      map[string]*atomic.Int64
+	inFlightMutex *sync.Mutex
+
+	baselines     map[string]*latencyWindow
+	baselineMutex *sync.Mutex
+
+	queueWaits     map[string]int
+	queueWaitMutex *sync.Mutex
+
+	banditDiscount float64
+	banditArms     map[string]map[string]*banditArm
+	banditMutex    *sync.Mutex
+
+	affinityTTLS  int
+	affinityKeys  map[string]map[string]*affinityAssignment
+	affinityLoads map[string]map[string]int
+	hashTables    map[string]map[uint64]*hashTable
+	affinityMutex *sync.Mutex
 }
 
-func NewBalancer(k3sClient *client.K3sClient, ownIP string, pingPort string) *Balancer {
+func NewBalancer(k3sClient *client.K3sClient, ownIP string, pingPort string, probeToken string) *Balancer {
 	rand.Seed(time.Now().Unix())
 
 	qosPercentage, err := strconv.ParseFloat(os.Getenv("QOS_PERC"), 64)
@@ -72,6 +124,12 @@ func NewBalancer(k3sClient *client.K3sClient, ownIP string, pingPort string) *Ba
 	}
 	log.Println("MAX_RES_USAGE:", maxResUsage)
 
+	maxQueueDepth, err := strconv.Atoi(os.Getenv("MAX_QUEUE_DEPTH"))
+	if err != nil {
+		maxQueueDepth = defaultMaxQueueDepth
+	}
+	log.Println("MAX_QUEUE_DEPTH:", maxQueueDepth)
+
 	newLatencyWeight, err := strconv.ParseFloat(os.Getenv("LAT_WEIGHT"), 64)
 	if err != nil {
 		newLatencyWeight = defaultNewLatencyWeight
@@ -90,6 +148,87 @@ func NewBalancer(k3sClient *client.K3sClient, ownIP string, pingPort string) *Ba
 	}
 	log.Println("COOLDOWN_BASE_DURATION_S:", cooldownBaseDuration)
 
+	breakerWindow, err := strconv.Atoi(os.Getenv("BREAKER_WINDOW"))
+	if err != nil || breakerWindow < 1 {
+		breakerWindow = defaultBreakerWindow
+	}
+	log.Println("BREAKER_WINDOW:", breakerWindow)
+
+	breakerMinRequests, err := strconv.Atoi(os.Getenv("BREAKER_MIN_REQUESTS"))
+	if err != nil {
+		breakerMinRequests = defaultBreakerMinRequests
+	}
+	log.Println("BREAKER_MIN_REQUESTS:", breakerMinRequests)
+
+	breakerFailureRate, err := strconv.ParseFloat(os.Getenv("BREAKER_FAILURE_RATE"), 64)
+	if err != nil {
+		breakerFailureRate = defaultBreakerFailureRate
+	}
+	log.Println("BREAKER_FAILURE_RATE:", breakerFailureRate)
+
+	breakerMaxOpenS, err := strconv.Atoi(os.Getenv("BREAKER_MAX_OPEN_S"))
+	if err != nil {
+		breakerMaxOpenS = defaultBreakerMaxOpenS
+	}
+	log.Println("BREAKER_MAX_OPEN_S:", breakerMaxOpenS)
+
+	breakerHalfOpenRequests, err := strconv.Atoi(os.Getenv("BREAKER_HALF_OPEN_REQUESTS"))
+	if err != nil || breakerHalfOpenRequests < 1 {
+		breakerHalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	log.Println("BREAKER_HALF_OPEN_REQUESTS:", breakerHalfOpenRequests)
+
+	outlierIntervalS, err := strconv.Atoi(os.Getenv("OUTLIER_INTERVAL_S"))
+	if err != nil || outlierIntervalS < 1 {
+		outlierIntervalS = defaultOutlierIntervalS
+	}
+	log.Println("OUTLIER_INTERVAL_S:", outlierIntervalS)
+
+	outlierBaseEjectionS, err := strconv.Atoi(os.Getenv("OUTLIER_BASE_EJECTION_S"))
+	if err != nil {
+		outlierBaseEjectionS = defaultOutlierBaseEjectionS
+	}
+	log.Println("OUTLIER_BASE_EJECTION_S:", outlierBaseEjectionS)
+
+	outlierMaxEjectionPerc, err := strconv.ParseFloat(os.Getenv("OUTLIER_MAX_EJECTION_PERC"), 64)
+	if err != nil {
+		outlierMaxEjectionPerc = defaultOutlierMaxEjectionPerc
+	}
+	log.Println("OUTLIER_MAX_EJECTION_PERC:", outlierMaxEjectionPerc)
+
+	outlierMinRequests, err := strconv.Atoi(os.Getenv("OUTLIER_MIN_REQUESTS"))
+	if err != nil {
+		outlierMinRequests = defaultOutlierMinRequests
+	}
+	log.Println("OUTLIER_MIN_REQUESTS:", outlierMinRequests)
+
+	outlierStdevFactor, err := strconv.ParseFloat(os.Getenv("OUTLIER_STDEV_FACTOR"), 64)
+	if err != nil {
+		outlierStdevFactor = defaultOutlierStdevFactor
+	}
+	log.Println("OUTLIER_STDEV_FACTOR:", outlierStdevFactor)
+
+	outlierLatencyFactor, err := strconv.ParseFloat(os.Getenv("OUTLIER_LATENCY_FACTOR"), 64)
+	if err != nil {
+		outlierLatencyFactor = defaultOutlierLatencyFactor
+	}
+	log.Println("OUTLIER_LATENCY_FACTOR:", outlierLatencyFactor)
+
+	stateFile := os.Getenv("STATE_FILE")
+	log.Println("STATE_FILE:", stateFile)
+
+	stateSnapshotS, err := strconv.Atoi(os.Getenv("STATE_SNAPSHOT_S"))
+	if err != nil || stateSnapshotS < 1 {
+		stateSnapshotS = defaultStateSnapshotS
+	}
+	log.Println("STATE_SNAPSHOT_S:", stateSnapshotS)
+
+	stateMaxAgeS, err := strconv.Atoi(os.Getenv("STATE_MAX_AGE_S"))
+	if err != nil {
+		stateMaxAgeS = defaultStateMaxAgeS
+	}
+	log.Println("STATE_MAX_AGE_S:", stateMaxAgeS)
+
 	realDataPeriod, err := strconv.Atoi(os.Getenv("REAL_DATA_VALID_S"))
 	if err != nil {
 		realDataPeriod = defaultRealDataPeriod
@@ -120,41 +259,197 @@ func NewBalancer(k3sClient *client.K3sClient, ownIP string, pingPort string) *Ba
 	}
 	log.Println("RANDOM_MODE:", randomMode)
 
+	// RANDOM_MODE only picks the default strategy when STRATEGY is not set
+	strategy := os.Getenv("STRATEGY")
+	if !strategies[strategy] {
+		strategy = strategyLatency
+		if randomMode {
+			strategy = strategyRandom
+		}
+	}
+	log.Println("STRATEGY:", strategy)
+
+	scoreWeightsValue, found := os.LookupEnv("SCORE_WEIGHTS")
+	if !found {
+		scoreWeightsValue = defaultScoreWeights
+	}
+	scoreWeights := parseScoreWeights(scoreWeightsValue)
+	log.Println("SCORE_WEIGHTS:", scoreWeights)
+
+	affinityTTLS, err := strconv.Atoi(os.Getenv("AFFINITY_TTL_S"))
+	if err != nil {
+		affinityTTLS = defaultAffinityTTLS
+	}
+	log.Println("AFFINITY_TTL_S:", affinityTTLS)
+
+	localityWeights := parseLocalityWeights(os.Getenv("LOCALITY_WEIGHTS"))
+	log.Println("LOCALITY_WEIGHTS:", localityWeights)
+
+	banditDiscount, err := strconv.ParseFloat(os.Getenv("BANDIT_DISCOUNT"), 64)
+	if err != nil || banditDiscount <= 0 || banditDiscount > 1 {
+		banditDiscount = defaultBanditDiscount
+	}
+	log.Println("BANDIT_DISCOUNT:", banditDiscount)
+
 	channels := make(map[string]chan map[string]*model.HostData)
 
-	return &Balancer{
+	b := &Balancer{
 		ownIP:                     ownIP,
 		k3sClient:                 k3sClient,
 		qosPercentage:             qosPercentage,
 		latencyWeight:             newLatencyWeight,
 		latencyApprWeight:         newLatencyApprWeight,
 		cooldownBaseDurationS:     cooldownBaseDuration,
+		breakerWindow:             breakerWindow,
+		breakerMinRequests:        breakerMinRequests,
+		breakerFailureRate:        breakerFailureRate,
+		breakerMaxOpenS:           breakerMaxOpenS,
+		breakerHalfOpenRequests:   breakerHalfOpenRequests,
+		breakers:                  make(map[string]*circuitBreaker),
+		breakerMutex:              &sync.Mutex{},
+		outlierBaseEjectionS:      outlierBaseEjectionS,
+		outlierMaxEjectionPerc:    outlierMaxEjectionPerc,
+		outlierMinRequests:        outlierMinRequests,
+		outlierStdevFactor:        outlierStdevFactor,
+		outlierLatencyFactor:      outlierLatencyFactor,
+		outlierStats:              make(map[string]map[string]*outlierStats),
+		ejections:                 make(map[string]map[string]*outlierEjection),
+		outlierMutex:              &sync.Mutex{},
+		stateFile:                 stateFile,
+		stateMaxAgeS:              stateMaxAgeS,
 		qosRecalculationCooldownS: qosRecalculationCooldownS,
 		qosRecalculationTime:      make(map[string]time.Time),
 		maxResUsage:               maxResUsage,
+		maxQueueDepth:             maxQueueDepth,
 		realDataPeriodS:           realDataPeriod,
 		pingPort:                  pingPort,
+		probeToken:                probeToken,
 		pingTimeout:               pingTimeout,
 		pingCacheTime:             pingCacheTime,
-		randomMode:                randomMode,
+		strategy:                  strategy,
+		scoreWeights:              scoreWeights,
+		stateMutex:                &sync.Mutex{},
 		hostPingCache:             make(map[string]*model.PingCache),
 		hostLatency:               make(map[string]map[string]*model.HostData),
 		serviceInit:               make(map[string]bool),
 		maxLatencies:              make(map[string]int),
 		channels:                  channels,
 		approxRunning:             make(map[string]*atomic.Bool),
+		localityWeights:           localityWeights,
+		inFlight:                  make(map[string]*atomic.Int64),
+		inFlightMutex:             &sync.Mutex{},
+		baselines:                 make(map[string]*latencyWindow),
+		baselineMutex:             &sync.Mutex{},
+		queueWaits:                make(map[string]int),
+		queueWaitMutex:            &sync.Mutex{},
+		banditDiscount:            banditDiscount,
+		banditArms:                make(map[string]map[string]*banditArm),
+		banditMutex:               &sync.Mutex{},
+		affinityTTLS:              affinityTTLS,
+		affinityKeys:              make(map[string]map[string]*affinityAssignment),
+		affinityLoads:             make(map[string]map[string]int),
+		hashTables:                make(map[string]map[uint64]*hashTable),
+		affinityMutex:             &sync.Mutex{},
+	}
+
+	if b.stateFile != "" {
+		if err := b.RestoreState(b.stateFile, time.Duration(b.stateMaxAgeS)*time.Second); err != nil {
+			log.Println("Failed to restore state from", b.stateFile, "::", err)
+		}
+	}
+
+	b.scheduler = cron.New(cron.WithSeconds())
+	_, _ = b.scheduler.AddFunc(fmt.Sprintf("@every %ds", outlierIntervalS), b.detectOutliers)
+	_, _ = b.scheduler.AddFunc(fmt.Sprintf("@every %ds", affinitySweepIntervalS), b.removeExpiredAssignments)
+	if b.stateFile != "" {
+		_, _ = b.scheduler.AddFunc(fmt.Sprintf("@every %ds", stateSnapshotS), b.saveState)
+	}
+	b.scheduler.Start()
+
+	return b
+}
+
+// IsResponsive reports whether the latency state can be locked within timeout, i.e. pods can be chosen
+func (b *Balancer) IsResponsive(timeout time.Duration) bool {
+	locked := make(chan struct{})
+	go func() {
+		b.stateMutex.Lock()
+		b.stateMutex.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Stop stops the outlier detection and the snapshots, waiting for running ones, and saves the state a last time
+func (b *Balancer) Stop() {
+	<-b.scheduler.Stop().Done()
+
+	if b.stateFile != "" {
+		b.saveState()
+	}
+}
+
+func (b *Balancer) ChoosePod(namespace string, service string, portName string) (string, string, string) {
+	return b.ChoosePodForKey(namespace, service, portName, "")
+}
+
+// ChoosePodForKey chooses a pod like ChoosePod, requests with the same non-empty key (e.g. a client ID or
+// a session cookie) are sent to the same pod as long as it satisfies the QoS
+func (b *Balancer) ChoosePodForKey(namespace string, service string, portName string, key string) (string, string, string) {
+	return b.ChoosePodWithFilter(namespace, service, portName, key, nil)
+}
+
+// ChoosePodWithFilter chooses a pod like ChoosePodForKey among the pods isAvailable accepts, e.g. pods below their
+// concurrency limit, pods it rejects are only chosen if it rejects all of them. A nil isAvailable accepts all pods.
+func (b *Balancer) ChoosePodWithFilter(namespace string, service string, portName string, key string, isAvailable func(podIP string) bool) (string, string, string) {
+	podIP, hostIP, targetPort := b.choosePodForKey(namespace, service, portName, key, isAvailable)
+	if podIP != "" {
+		b.onPodSelected(model.ServiceKey(namespace, service), hostIP)
+	}
+
+	return podIP, hostIP, targetPort
+}
+
+// CancelSelection undoes the bookkeeping of choosing a pod for a request that is not sent after all: the trial of
+// a half-open circuit breaker and the assignment of the key if it was made for the request
+func (b *Balancer) CancelSelection(namespace string, service string, podIP string, hostIP string, key string) {
+	serviceKey := model.ServiceKey(namespace, service)
+	b.cancelPodSelected(serviceKey, hostIP)
+	if key != "" {
+		b.cancelAffinityPod(serviceKey, key, podIP)
 	}
 }
 
-func (b *Balancer) ChoosePod(namespace string, service string) (string, string, string) {
-	podsAll, annotations, targetPort, err := b.k3sClient.GetPodsForService(namespace, service)
+func (b *Balancer) choosePodForKey(namespace string, service string, portName string, key string, isAvailable func(podIP string) bool) (string, string, string) {
+	podsAll, annotations, ports, err := b.k3sClient.GetPodsForService(namespace, service)
 	if err != nil {
 		log.Println("Failed to retrieve pods for service :: ", err.Error())
 		return "", "", ""
 	}
-	pods := b.filterHealthyPods(podsAll, service)
+	servicePort := selectServicePort(ports, portName)
+	if servicePort == nil {
+		log.Println("No port", portName, "found for service ::", service)
+		return "", "", ""
+	}
+	podsAll = filterPodsWithTargetPort(podsAll, servicePort)
+	if len(podsAll) == 0 {
+		log.Println("No pods with target port", servicePort.TargetPort, "found for service ::", service)
+		return "", "", ""
+	}
+
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+
+	serviceKey := model.ServiceKey(namespace, service)
+	pods := b.filterHealthyPods(podsAll, serviceKey)
 	if len(pods) == 0 {
-		log.Println("No pods found for service, returning nil ::", service)
+		log.Println("No pods found for service, returning nil ::", serviceKey)
 		return "", "", ""
 	}
 
@@ -163,6 +458,13 @@ func (b *Balancer) ChoosePod(namespace string, service string) (string, string,
 		log.Print(pd.HostIP, " ", pd.IP)
 	}
 
+	// pods at their concurrency limit are only chosen when all pods are, requests then queue for them
+	candidates := getAvailablePods(pods, isAvailable)
+	available := make(map[string]bool, len(candidates))
+	for _, pod := range candidates {
+		available[pod.IP] = true
+	}
+
 	maxVal, err := strconv.Atoi(annotations["maxLatency"])
 	if err != nil {
 		maxVal = defaultMaxLatency
@@ -170,32 +472,39 @@ func (b *Balancer) ChoosePod(namespace string, service string) (string, string,
 	maxLatency := maxVal
 
 	// start apporixmating the request latency on first request for a service
-	if !b.serviceInit[service] {
-		b.serviceInit[service] = true
-		b.channels[service] = make(chan map[string]*model.HostData)
-		b.maxLatencies[service] = maxLatency
+	if !b.serviceInit[serviceKey] {
+		b.serviceInit[serviceKey] = true
+		b.channels[serviceKey] = make(chan map[string]*model.HostData)
+		b.maxLatencies[serviceKey] = maxLatency
 
-		b.approxRunning[service] = &atomic.Bool{}
-		b.approxRunning[service].Store(true)
+		b.approxRunning[serviceKey] = &atomic.Bool{}
+		b.approxRunning[serviceKey].Store(true)
 
-		b.qosRecalculationTime[service] = time.Now()
+		b.qosRecalculationTime[serviceKey] = time.Now()
 
-		go b.ApproximateLatency(podsAll, service, maxLatency)
+		go b.ApproximateLatency(podsAll, serviceKey, maxLatency)
 	} else {
 		select {
-		case x, ok := <-b.channels[service]:
+		case x, ok := <-b.channels[serviceKey]:
 			if ok {
-				b.approxRunning[service].Store(false)
-				b.adjustLatencies(service, x)
-				log.Println("Adjusted latencies for service ::", service)
+				b.approxRunning[serviceKey].Store(false)
+				b.adjustLatencies(serviceKey, x)
+				log.Println("Adjusted latencies for service ::", serviceKey)
 			} else {
-				log.Println("Channel closed for service", service)
+				log.Println("Channel closed for service", serviceKey)
 			}
 		default:
-			log.Println("No value ready for service", service, ", moving on.")
+			log.Println("No value ready for service", serviceKey, ", moving on.")
 		}
 	}
 
+	// bandit strategies explore all healthy pods themselves, without the QoS set and its recalculation
+	strategy := b.getStrategy(annotations)
+	if key == "" && (strategy == strategyUCB || strategy == strategyThompson) {
+		selectedPod := b.chooseByBandit(strategy, serviceKey, candidates)
+		return selectedPod.IP, selectedPod.HostIP, podTargetPort(selectedPod, servicePort)
+	}
+
 	var bestPodIPs []model.PodInfo
 	var overloadedPodsIPs []model.PodInfo
 	skipNodeStatus := false
@@ -207,28 +516,39 @@ func (b *Balancer) ChoosePod(namespace string, service string) (string, string,
 	}
 
 	newPodDetected := false
+	qosPodCount := 0
 	for _, pod := range pods {
-		if b.hostLatency[pod.HostIP] == nil || b.hostLatency[pod.HostIP][service] == nil {
+		if b.hostLatency[pod.HostIP] == nil || b.hostLatency[pod.HostIP][serviceKey] == nil {
 			newPodDetected = true
 			continue
 		}
 
-		serviceStatus := b.hostLatency[pod.HostIP][service]
+		serviceStatus := b.hostLatency[pod.HostIP][serviceKey]
 		if serviceStatus.Latency < maxLatency {
-			if !skipNodeStatus && nodeStatus[pod.HostIP] != nil && (nodeStatus[pod.HostIP].CpuUsage > b.maxResUsage || nodeStatus[pod.HostIP].RamUsage > b.maxResUsage) {
+			qosPodCount++
+			if !available[pod.IP] {
+				log.Println("Pod", pod.IP, "is at its concurrency limit, skipping it")
+				continue
+			}
+			if b.isOverloaded(pod.HostIP, serviceKey, nodeStatus, skipNodeStatus) {
 				log.Println(pod.HostIP, "is overloaded, skipping pod", pod.IP)
-				overloadedPodsIPs = append(overloadedPodsIPs, model.PodInfo{IP: pod.IP, HostIP: pod.HostIP})
+				overloadedPodsIPs = append(overloadedPodsIPs, *pod)
 			} else {
-				bestPodIPs = append(bestPodIPs, model.PodInfo{IP: pod.IP, HostIP: pod.HostIP})
+				bestPodIPs = append(bestPodIPs, *pod)
 			}
 		}
 	}
 
 	// not enough QoS pods, recalculate!
-	if (!b.checkQoSMin(len(pods), len(bestPodIPs)+len(overloadedPodsIPs)) || newPodDetected) && int(time.Since(b.qosRecalculationTime[service]).Seconds()) > b.qosRecalculationCooldownS && b.approxRunning[service].CompareAndSwap(false, true) {
+	if (!b.checkQoSMin(len(pods), qosPodCount) || newPodDetected) && int(time.Since(b.qosRecalculationTime[serviceKey]).Seconds()) > b.qosRecalculationCooldownS && b.approxRunning[serviceKey].CompareAndSwap(false, true) {
 		log.Println("QoS Min check failed! Running approximation again")
-		b.qosRecalculationTime[service] = time.Now()
-		go b.ApproximateLatency(podsAll, service, maxLatency)
+		b.qosRecalculationTime[serviceKey] = time.Now()
+		go b.ApproximateLatency(podsAll, serviceKey, maxLatency)
+	}
+
+	// the score strategy weighs resource usage instead of excluding overloaded pods
+	if strategy == strategyScore {
+		bestPodIPs = append(bestPodIPs, overloadedPodsIPs...)
 	}
 
 	// if there are no good pod IPs with good latency, send to overloaded ones
@@ -237,102 +557,152 @@ func (b *Balancer) ChoosePod(namespace string, service string) (string, string,
 		bestPodIPs = overloadedPodsIPs
 	}
 
-	// select a random pod from pods that satisfy QoS
+	// select a pod from pods that satisfy QoS, keyed requests are consistently hashed over them
 	if len(bestPodIPs) > 0 {
-		index := rand.Intn(len(bestPodIPs))
-		if b.randomMode {
-			log.Println("Choosing a random Pod IP from the list that satisify QoS")
-			return bestPodIPs[index].IP, bestPodIPs[index].HostIP, targetPort
-		} else {
-			sort.SliceStable(bestPodIPs, func(i, j int) bool {
-				return b.hostLatency[bestPodIPs[i].HostIP][service].Latency < b.hostLatency[bestPodIPs[j].HostIP][service].Latency
-			})
-
-			log.Println("Selected a pod based on Node resource usage and latency")
-
-			return bestPodIPs[0].IP, bestPodIPs[0].HostIP, targetPort
+		if key != "" {
+			affinityPod := b.chooseAffinityPod(serviceKey, key, bestPodIPs, annotations)
+			log.Println("Choosing the affinity pod for key", key, "::", affinityPod.IP)
+			return affinityPod.IP, affinityPod.HostIP, podTargetPort(affinityPod, servicePort)
 		}
+
+		selectedPod := b.selectPod(strategy, serviceKey, bestPodIPs, annotations, nodeStatus, maxLatency)
+		return selectedPod.IP, selectedPod.HostIP, podTargetPort(selectedPod, servicePort)
 	}
 
 	// if none are valid select on own pod
-	for _, pod := range pods {
+	for _, pod := range candidates {
 		if b.ownIP == pod.HostIP {
 			log.Println("None satisfy the QoS, try to route to local")
-			return pod.IP, pod.HostIP, targetPort
+			return pod.IP, pod.HostIP, podTargetPort(pod, servicePort)
 		}
 	}
 
 	log.Println("Other routing roules failed, routing random")
 	// all else fails, revert to random
-	index := rand.Intn(len(pods))
-	return pods[index].IP, pods[index].HostIP, targetPort
+	index := rand.Intn(len(candidates))
+	return candidates[index].IP, candidates[index].HostIP, podTargetPort(candidates[index], servicePort)
+}
+
+// getAvailablePods returns the pods isAvailable accepts, or all pods if it accepts none
+func getAvailablePods(pods []*model.PodInfo, isAvailable func(podIP string) bool) []*model.PodInfo {
+	if isAvailable == nil {
+		return pods
+	}
+
+	result := make([]*model.PodInfo, 0, len(pods))
+	for _, pod := range pods {
+		if isAvailable(pod.IP) {
+			result = append(result, pod)
+		}
+	}
+	if len(result) == 0 {
+		return pods
+	}
+
+	return result
+}
+
+// IsServicePort reports whether portName matches the name or number of one of the service ports
+func (b *Balancer) IsServicePort(namespace string, service string, portName string) bool {
+	_, _, ports, err := b.k3sClient.GetPodsForService(namespace, service)
+	if err != nil || portName == "" {
+		return false
+	}
+
+	return selectServicePort(ports, portName) != nil
+}
+
+// GetServiceAnnotation returns the value of an annotation of the service, or an empty string if it is not set
+func (b *Balancer) GetServiceAnnotation(namespace string, service string, name string) string {
+	_, annotations, _, err := b.k3sClient.GetPodsForService(namespace, service)
+	if err != nil {
+		return ""
+	}
+
+	return annotations[name]
 }
 
-func (b *Balancer) SetLatency(hostIP string, latency int, service string) {
+func (b *Balancer) SetLatency(hostIP string, latency int, namespace string, service string) {
+	serviceKey := model.ServiceKey(namespace, service)
+
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+	b.rewardArm(serviceKey, hostIP, latency <= b.getMaxLatency(serviceKey))
+	b.recordBreaker(serviceKey, hostIP, true)
+	b.recordOutlier(serviceKey, hostIP, true)
+
 	latencyHost := b.hostLatency[hostIP]
 	if latencyHost == nil {
 		b.hostLatency[hostIP] = make(map[string]*model.HostData)
-		b.hostLatency[hostIP][service] = &model.HostData{
+		b.hostLatency[hostIP][serviceKey] = &model.HostData{
 			Latency:          latency,
 			IsServiceHealthy: true,
 			IsApproximated:   false,
 			FailedReqCounter: 0,
 			ReqTime:          time.Now(),
 		}
-		log.Println("Adjust latency data for |", hostIP, service, latency, "| => |", b.hostLatency[hostIP][service], "|")
+		log.Println("Adjust latency data for |", hostIP, serviceKey, latency, "| => |", b.hostLatency[hostIP][serviceKey], "|")
 		return
 	}
 
-	if latencyHost[service] == nil {
-		latencyHost[service] = &model.HostData{
+	if latencyHost[serviceKey] == nil {
+		latencyHost[serviceKey] = &model.HostData{
 			Latency:          latency,
 			IsServiceHealthy: true,
 			IsApproximated:   false,
 			FailedReqCounter: 0,
 			ReqTime:          time.Now(),
 		}
-		log.Println("Adjust latency data for |", hostIP, service, latency, "| => |", b.hostLatency[hostIP][service], "|")
+		log.Println("Adjust latency data for |", hostIP, serviceKey, latency, "| => |", b.hostLatency[hostIP][serviceKey], "|")
 		return
 	}
 
-	if latencyHost[service].IsApproximated {
-		log.Println("Last latency for service", service, "was approximated. Using weight ::", b.latencyApprWeight)
-		latencyHost[service].Latency = int((1-b.latencyApprWeight)*float64(latencyHost[service].Latency) + b.latencyApprWeight*float64(latency))
+	if latencyHost[serviceKey].IsApproximated {
+		log.Println("Last latency for service", serviceKey, "was approximated. Using weight ::", b.latencyApprWeight)
+		latencyHost[serviceKey].Latency = int((1-b.latencyApprWeight)*float64(latencyHost[serviceKey].Latency) + b.latencyApprWeight*float64(latency))
 	} else {
-		latencyHost[service].Latency = int((1-b.latencyWeight)*float64(latencyHost[service].Latency) + b.latencyWeight*float64(latency))
+		latencyHost[serviceKey].Latency = int((1-b.latencyWeight)*float64(latencyHost[serviceKey].Latency) + b.latencyWeight*float64(latency))
 	}
 
-	latencyHost[service].FailedReqCounter = 0
-	latencyHost[service].IsApproximated = false
-	latencyHost[service].IsServiceHealthy = true
-	latencyHost[service].ReqTime = time.Now()
+	latencyHost[serviceKey].FailedReqCounter = 0
+	latencyHost[serviceKey].IsApproximated = false
+	latencyHost[serviceKey].IsServiceHealthy = true
+	latencyHost[serviceKey].ReqTime = time.Now()
 
-	log.Println("Adjust latency data for |", hostIP, service, latency, "| => |", latencyHost[service], "|")
+	log.Println("Adjust latency data for |", hostIP, serviceKey, latency, "| => |", latencyHost[serviceKey], "|")
 }
 
-func (b *Balancer) SetReqFailed(hostIP string, service string) {
+func (b *Balancer) SetReqFailed(hostIP string, namespace string, service string) {
+	serviceKey := model.ServiceKey(namespace, service)
+
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+	b.rewardArm(serviceKey, hostIP, false)
+	b.recordBreaker(serviceKey, hostIP, false)
+	b.recordOutlier(serviceKey, hostIP, false)
+
 	if b.hostLatency[hostIP] == nil {
 		b.hostLatency[hostIP] = make(map[string]*model.HostData)
 	}
 
-	if b.hostLatency[hostIP][service] == nil {
-		b.hostLatency[hostIP][service] = &model.HostData{
+	if b.hostLatency[hostIP][serviceKey] == nil {
+		b.hostLatency[hostIP][serviceKey] = &model.HostData{
 			IsServiceHealthy: false,
 			ReqTime:          time.Now(),
 			FailedReqCounter: 1,
 		}
 	} else {
-		b.hostLatency[hostIP][service].IsServiceHealthy = false
-		b.hostLatency[hostIP][service].ReqTime = time.Now()
-		b.hostLatency[hostIP][service].FailedReqCounter++
+		b.hostLatency[hostIP][serviceKey].IsServiceHealthy = false
+		b.hostLatency[hostIP][serviceKey].ReqTime = time.Now()
+		b.hostLatency[hostIP][serviceKey].FailedReqCounter++
 	}
 
-	log.Println("Request failed, sending on cooldown ::", b.hostLatency[hostIP][service])
+	log.Println("Request failed ::", b.hostLatency[hostIP][serviceKey])
 }
 
-func (b *Balancer) ApproximateLatency(pods []*model.PodInfo, service string, maxLatency int) {
+func (b *Balancer) ApproximateLatency(pods []*model.PodInfo, serviceKey string, maxLatency int) {
 	hostLatency := make(map[string]*model.HostData)
-	log.Println("GO: Approximating latency for service", service)
+	log.Println("GO: Approximating latency for service", serviceKey)
 
 	for _, pod := range pods {
 		var latency int
@@ -341,19 +711,27 @@ func (b *Balancer) ApproximateLatency(pods []*model.PodInfo, service string, max
 			continue
 		}
 
-		if val, ok := b.hostPingCache[pod.HostIP]; ok && int(time.Since(val.CacheTime).Seconds()) < b.pingCacheTime {
+		b.stateMutex.Lock()
+		val, ok := b.hostPingCache[pod.HostIP]
+		b.stateMutex.Unlock()
+
+		if ok && int(time.Since(val.CacheTime).Seconds()) < b.pingCacheTime {
 			latency = val.Latency
 			log.Println("GO: Using cached latency for host", pod.HostIP)
 		} else {
-			latency = pingHost("http://"+pod.HostIP+":"+b.pingPort+pingURLSuffix, b.pingTimeout)
+			var probe *model.ProbeResponse
+			latency, probe = pingHost("http://"+pod.HostIP+":"+b.pingPort+pingURLSuffix, b.pingTimeout, b.probeToken)
 
 			if latency == -1 {
 				latency = maxLatency
 			} else {
+				b.stateMutex.Lock()
 				b.hostPingCache[pod.HostIP] = &model.PingCache{
 					CacheTime: time.Now(),
 					Latency:   latency,
+					Probe:     probe,
 				}
+				b.stateMutex.Unlock()
 			}
 		}
 
@@ -368,26 +746,48 @@ func (b *Balancer) ApproximateLatency(pods []*model.PodInfo, service string, max
 	}
 
 	// new latencies calculated, give it to the main thread
-	b.channels[service] <- hostLatency
+	b.stateMutex.Lock()
+	channel := b.channels[serviceKey]
+	b.stateMutex.Unlock()
+	channel <- hostLatency
 }
 
-func (b *Balancer) adjustLatencies(service string, x map[string]*model.HostData) {
+func (b *Balancer) adjustLatencies(serviceKey string, x map[string]*model.HostData) {
 	for k, v := range x {
 		if b.hostLatency[k] == nil {
 			b.hostLatency[k] = make(map[string]*model.HostData)
 		}
 
-		if b.hostLatency[k][service] == nil {
-			b.hostLatency[k][service] = v
+		if b.hostLatency[k][serviceKey] == nil {
+			b.hostLatency[k][serviceKey] = v
 		} else {
-			if int(time.Since(b.hostLatency[k][service].ReqTime).Seconds()) > b.realDataPeriodS || b.hostLatency[k][service].IsApproximated {
-				b.hostLatency[k][service].Latency = v.Latency
-				b.hostLatency[k][service].IsApproximated = v.IsApproximated
+			if int(time.Since(b.hostLatency[k][serviceKey].ReqTime).Seconds()) > b.realDataPeriodS || b.hostLatency[k][serviceKey].IsApproximated {
+				b.hostLatency[k][serviceKey].Latency = v.Latency
+				b.hostLatency[k][serviceKey].IsApproximated = v.IsApproximated
 			}
 		}
 	}
 }
 
+// isOverloaded reports whether the CPU or RAM usage of the node exceeds MAX_RES_USAGE or its proxy queues more than
+// MAX_QUEUE_DEPTH requests for the service, the load reported by a recent probe of the node takes precedence over
+// the node metrics
+func (b *Balancer) isOverloaded(hostIP string, serviceKey string, nodeStatus map[string]*model.NodeMetrics, skipNodeStatus bool) bool {
+	if pingCache := b.hostPingCache[hostIP]; pingCache != nil && pingCache.Probe != nil && int(time.Since(pingCache.CacheTime).Seconds()) < b.pingCacheTime {
+		return pingCache.Probe.CpuUsage > b.maxResUsage || pingCache.Probe.RamUsage > b.maxResUsage || pingCache.Probe.QueueDepths[serviceKey] > b.maxQueueDepth
+	}
+
+	return !skipNodeStatus && nodeStatus[hostIP] != nil && (nodeStatus[hostIP].CpuUsage > b.maxResUsage || nodeStatus[hostIP].RamUsage > b.maxResUsage)
+}
+
+func (b *Balancer) getMaxLatency(serviceKey string) int {
+	if maxLatency, found := b.maxLatencies[serviceKey]; found {
+		return maxLatency
+	}
+
+	return defaultMaxLatency
+}
+
 func (b *Balancer) checkQoSMin(podNum int, goodPodsNum int) bool {
 	validQosMin := float64(goodPodsNum)/float64(podNum) >= b.qosPercentage
 	log.Println("Check if QoS Min is satisifed ::", validQosMin)
@@ -395,25 +795,67 @@ func (b *Balancer) checkQoSMin(podNum int, goodPodsNum int) bool {
 	return validQosMin
 }
 
-func (b *Balancer) isServiceInTimeout(serviceStatus *model.HostData) bool {
-	isInTimeout := time.Since(serviceStatus.ReqTime).Seconds() < float64(b.cooldownBaseDurationS)*float64(serviceStatus.FailedReqCounter)
+func (b *Balancer) filterHealthyPods(pods []*model.PodInfo, serviceKey string) []*model.PodInfo {
+	result := make([]*model.PodInfo, 0)
+	for _, pod := range pods {
+		if !b.isEjected(serviceKey, pod.HostIP) && b.isBreakerAllowed(serviceKey, pod.HostIP) {
+			result = append(result, pod)
+		}
+	}
 
-	return !serviceStatus.IsServiceHealthy && isInTimeout
+	return result
 }
 
-func (b *Balancer) filterHealthyPods(pods []*model.PodInfo, service string) []*model.PodInfo {
-	result := make([]*model.PodInfo, 0)
+func selectServicePort(ports []*model.ServicePort, portName string) *model.ServicePort {
+	if len(ports) == 0 {
+		return nil
+	}
+
+	// without an explicit port the first service port is used
+	if portName == "" {
+		return ports[0]
+	}
+
+	for _, port := range ports {
+		if port.Name == portName || port.Port == portName {
+			return port
+		}
+	}
+
+	return nil
+}
+
+// filterPodsWithTargetPort leaves out the pods that do not declare a named target port, like endpoints without the
+// port are left out by kube-proxy
+func filterPodsWithTargetPort(pods []*model.PodInfo, servicePort *model.ServicePort) []*model.PodInfo {
+	if _, err := strconv.Atoi(servicePort.TargetPort); err == nil {
+		return pods
+	}
+
+	result := make([]*model.PodInfo, 0, len(pods))
 	for _, pod := range pods {
-		serviceStatus := b.hostLatency[pod.HostIP][service]
-		if serviceStatus == nil || !b.isServiceInTimeout(serviceStatus) {
+		if _, ok := pod.Ports[servicePort.TargetPort]; ok {
 			result = append(result, pod)
+		} else {
+			log.Println("Named target port", servicePort.TargetPort, "not found on pod", pod.Name, ", skipping it")
 		}
 	}
 
 	return result
 }
 
-func pingHost(hostUrl string, timeoutS int) int {
+// podTargetPort resolves the target port on a pod left by filterPodsWithTargetPort
+func podTargetPort(pod *model.PodInfo, servicePort *model.ServicePort) string {
+	if _, err := strconv.Atoi(servicePort.TargetPort); err == nil {
+		return servicePort.TargetPort
+	}
+
+	// named target port, resolve it against the container ports of the selected pod
+	return pod.Ports[servicePort.TargetPort]
+}
+
+// pingHost measures the round trip to the probe server of the proxy on a host, which also reports the load of the node
+func pingHost(hostUrl string, timeoutS int, token string) (int, *model.ProbeResponse) {
 	start := time.Now()
 	client := &http.Client{
 		Timeout: time.Duration(timeoutS) * time.Second, // Set the timeout duration
@@ -422,24 +864,33 @@ func pingHost(hostUrl string, timeoutS int) int {
 	request, err := http.NewRequest("GET", hostUrl, nil)
 	if err != nil {
 		log.Println("GO: Error creating GET request:", err.Error())
-		return -1
+		return -1, nil
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
 	}
 
 	response, err := client.Do(request)
 	if err != nil {
 		log.Println("GO: Error sending GET request:", err.Error())
-		return -1
+		return -1, nil
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		log.Println("GO: Probe of host", hostUrl, "failed with status", response.Status)
+		return -1, nil
+	}
+
 	// Read the response body
-	_, err = ioutil.ReadAll(response.Body)
+	probe := &model.ProbeResponse{}
+	err = json.NewDecoder(response.Body).Decode(probe)
 	if err != nil {
 		log.Println("GO: Error reading response body:", err.Error())
-		return -1
+		return -1, nil
 	}
 
-	log.Println("GO: Host", hostUrl, "pinged! Result", time.Since(start))
+	log.Println("GO: Host", hostUrl, "pinged! Result", time.Since(start), "load", probe)
 
-	return int(time.Since(start).Milliseconds())
+	return int(time.Since(start).Milliseconds()), probe
 }
@@ -0,0 +1,129 @@
+package balancer
+
+import (
+	"log"
+	"math"
+	"math/rand"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+)
+
+const defaultBanditDiscount float64 = 0.99
+
+// banditArm holds the discounted number of requests to a host that did and did not meet maxLatency
+type banditArm struct {
+	successes float64
+	failures  float64
+}
+
+// rewardArm records whether a request to the host met maxLatency, older outcomes of all hosts of the
+// service are discounted so the arms follow changes in the network and the load of the nodes
+func (b *Balancer) rewardArm(serviceKey string, hostIP string, success bool) {
+	b.banditMutex.Lock()
+	defer b.banditMutex.Unlock()
+
+	arms := b.banditArms[serviceKey]
+	if arms == nil {
+		arms = make(map[string]*banditArm)
+		b.banditArms[serviceKey] = arms
+	}
+	for _, arm := range arms {
+		arm.successes *= b.banditDiscount
+		arm.failures *= b.banditDiscount
+	}
+
+	arm := arms[hostIP]
+	if arm == nil {
+		arm = &banditArm{}
+		arms[hostIP] = arm
+	}
+	if success {
+		arm.successes++
+	} else {
+		arm.failures++
+	}
+}
+
+// chooseByBandit treats the hosts of the pods as arms and picks one with UCB1 or Thompson sampling,
+// a random pod on the chosen host is returned
+func (b *Balancer) chooseByBandit(strategy string, serviceKey string, pods []*model.PodInfo) *model.PodInfo {
+	b.banditMutex.Lock()
+	arms := make(map[string]banditArm)
+	for _, pod := range pods {
+		if arm := b.banditArms[serviceKey][pod.HostIP]; arm != nil {
+			arms[pod.HostIP] = *arm
+		} else {
+			arms[pod.HostIP] = banditArm{}
+		}
+	}
+	b.banditMutex.Unlock()
+
+	totalPulls := 0.0
+	for _, arm := range arms {
+		totalPulls += arm.successes + arm.failures
+	}
+
+	selectedHost := ""
+	bestValue := math.Inf(-1)
+	for hostIP, arm := range arms {
+		var value float64
+		if strategy == strategyThompson {
+			value = sampleBeta(arm.successes+1, arm.failures+1)
+		} else {
+			value = ucbValue(arm, totalPulls)
+		}
+
+		if value > bestValue || (value == bestValue && rand.Intn(2) == 0) {
+			selectedHost = hostIP
+			bestValue = value
+		}
+	}
+	log.Println("Bandit", strategy, "selected host", selectedHost, "::", bestValue)
+
+	var hostPods []*model.PodInfo
+	for _, pod := range pods {
+		if pod.HostIP == selectedHost {
+			hostPods = append(hostPods, pod)
+		}
+	}
+
+	return hostPods[rand.Intn(len(hostPods))]
+}
+
+// ucbValue is the mean reward of the arm plus an exploration bonus that shrinks as the arm is pulled,
+// arms without requests are always tried first
+func ucbValue(arm banditArm, totalPulls float64) float64 {
+	pulls := arm.successes + arm.failures
+	if pulls < 1 {
+		return math.Inf(1)
+	}
+
+	return arm.successes/pulls + math.Sqrt(2*math.Log(math.Max(totalPulls, 1))/pulls)
+}
+
+// sampleBeta samples Beta(alpha, beta) from two gamma samples, alpha and beta must be at least 1
+func sampleBeta(alpha float64, beta float64) float64 {
+	x := sampleGamma(alpha)
+	y := sampleGamma(beta)
+
+	return x / (x + y)
+}
+
+// sampleGamma samples Gamma(shape, 1) for shape >= 1 with the Marsaglia and Tsang method
+func sampleGamma(shape float64) float64 {
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rand.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+
+		u := rand.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
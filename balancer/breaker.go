@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+const defaultBreakerWindow int = 20
+const defaultBreakerMinRequests int = 5
+const defaultBreakerFailureRate float64 = 0.5
+const defaultBreakerMaxOpenS int = 300
+const defaultBreakerHalfOpenRequests int = 3
+
+// circuitBreaker tracks the outcomes of the last requests to a service on a host. It opens when the failure rate
+// over the window exceeds the threshold, stays open for an exponentially growing duration, then lets a limited
+// number of trial requests through (half-open) and closes once they all succeed.
+type circuitBreaker struct {
+	state    string
+	outcomes []bool
+	next     int
+	count    int
+
+	openedAt  time.Time
+	openCount int
+
+	trials       int
+	trialSuccess int
+	trialsAt     time.Time
+}
+
+func (b *Balancer) getBreaker(serviceKey string, hostIP string) *circuitBreaker {
+	key := serviceKey + "/" + hostIP
+	breaker := b.breakers[key]
+	if breaker == nil {
+		breaker = &circuitBreaker{state: breakerClosed, outcomes: make([]bool, b.breakerWindow)}
+		b.breakers[key] = breaker
+	}
+
+	return breaker
+}
+
+// isBreakerAllowed reports whether a request may be sent to the service on the host, an open breaker
+// becomes half-open once its open duration passed
+func (b *Balancer) isBreakerAllowed(serviceKey string, hostIP string) bool {
+	b.breakerMutex.Lock()
+	defer b.breakerMutex.Unlock()
+
+	breaker := b.getBreaker(serviceKey, hostIP)
+	if breaker.state == breakerOpen && time.Since(breaker.openedAt) >= b.getOpenDuration(breaker) {
+		log.Println("Circuit breaker of", serviceKey, "on", hostIP, "is half-open")
+		breaker.state = breakerHalfOpen
+		breaker.trials = 0
+		breaker.trialSuccess = 0
+		breaker.trialsAt = time.Now()
+	}
+
+	switch breaker.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		// trials without an outcome, e.g. canceled requests, are given up after the base open duration
+		if breaker.trials >= b.breakerHalfOpenRequests && time.Since(breaker.trialsAt) > time.Duration(b.cooldownBaseDurationS)*time.Second {
+			breaker.trials = breaker.trialSuccess
+			breaker.trialsAt = time.Now()
+		}
+		return breaker.trials < b.breakerHalfOpenRequests
+	}
+
+	return true
+}
+
+// onPodSelected counts a request sent to a half-open breaker as one of its trials
+func (b *Balancer) onPodSelected(serviceKey string, hostIP string) {
+	b.breakerMutex.Lock()
+	defer b.breakerMutex.Unlock()
+
+	if breaker := b.getBreaker(serviceKey, hostIP); breaker.state == breakerHalfOpen {
+		breaker.trials++
+	}
+}
+
+// cancelPodSelected gives back the trial of a request that was not sent to a half-open breaker
+func (b *Balancer) cancelPodSelected(serviceKey string, hostIP string) {
+	b.breakerMutex.Lock()
+	defer b.breakerMutex.Unlock()
+
+	if breaker := b.getBreaker(serviceKey, hostIP); breaker.state == breakerHalfOpen && breaker.trials > breaker.trialSuccess {
+		breaker.trials--
+	}
+}
+
+// recordBreaker records the outcome of a request to the service on the host
+func (b *Balancer) recordBreaker(serviceKey string, hostIP string, success bool) {
+	b.breakerMutex.Lock()
+	defer b.breakerMutex.Unlock()
+
+	breaker := b.getBreaker(serviceKey, hostIP)
+	switch breaker.state {
+	case breakerHalfOpen:
+		if !success {
+			b.openBreaker(serviceKey, hostIP, breaker)
+			return
+		}
+
+		breaker.trialSuccess++
+		if breaker.trialSuccess >= b.breakerHalfOpenRequests {
+			log.Println("Circuit breaker of", serviceKey, "on", hostIP, "is closed")
+			breaker.state = breakerClosed
+			breaker.openCount = 0
+		}
+	case breakerClosed:
+		breaker.outcomes[breaker.next] = success
+		breaker.next = (breaker.next + 1) % len(breaker.outcomes)
+		breaker.count = int(math.Min(float64(breaker.count+1), float64(len(breaker.outcomes))))
+
+		failures := 0
+		for i := 0; i < breaker.count; i++ {
+			if !breaker.outcomes[i] {
+				failures++
+			}
+		}
+		if breaker.count >= b.breakerMinRequests && float64(failures)/float64(breaker.count) >= b.breakerFailureRate {
+			b.openBreaker(serviceKey, hostIP, breaker)
+		}
+	}
+}
+
+func (b *Balancer) openBreaker(serviceKey string, hostIP string, breaker *circuitBreaker) {
+	breaker.state = breakerOpen
+	breaker.openedAt = time.Now()
+	breaker.openCount++
+	breaker.count = 0
+	breaker.next = 0
+
+	log.Println("Circuit breaker of", serviceKey, "on", hostIP, "is open for", b.getOpenDuration(breaker))
+}
+
+// getOpenDuration doubles the base duration (COOLDOWN_BASE_DURATION_S) each time the breaker opens again without
+// closing in between, up to BREAKER_MAX_OPEN_S
+func (b *Balancer) getOpenDuration(breaker *circuitBreaker) time.Duration {
+	openS := float64(b.cooldownBaseDurationS) * math.Pow(2, float64(breaker.openCount-1))
+
+	return time.Duration(math.Min(openS, float64(b.breakerMaxOpenS))) * time.Second
+}
+
+// GetBreakerStates returns the state of the circuit breakers that are not closed by service key and host IP
+func (b *Balancer) GetBreakerStates() map[string]string {
+	b.breakerMutex.Lock()
+	defer b.breakerMutex.Unlock()
+
+	result := make(map[string]string)
+	for key, breaker := range b.breakers {
+		if breaker.state != breakerClosed {
+			result[key] = breaker.state
+		}
+	}
+
+	return result
+}
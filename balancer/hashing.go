@@ -0,0 +1,318 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+)
+
+const (
+	hashAlgorithmRing   = "ring"
+	hashAlgorithmMaglev = "maglev"
+)
+
+const ringReplicas int = 100
+const maglevTableSize int = 65537
+const defaultHashLoadFactor float64 = 1.25
+
+// tables of the candidate sets a service switches between, e.g. while a pod toggles between overloaded and not
+const maxHashTables int = 8
+const affinitySweepIntervalS int = 60
+
+// hashTable maps keys to an ordered preference of pods, the first pod that is not overloaded is used
+type hashTable struct {
+	signature string
+	algorithm string
+	podIPs    []string
+	lastUsed  time.Time
+
+	// ring: sorted virtual node hashes and their pod index, maglev: lookup table of pod indices
+	ringHashes []uint64
+	ringPods   []int
+	lookup     []int
+}
+
+type affinityAssignment struct {
+	podIP      string
+	lastSeen   time.Time
+	selections int
+}
+
+// chooseAffinityPod keeps a key on its assigned pod while the pod satisfies QoS, otherwise the key is
+// (re)hashed over the candidates with bounded load: no pod gets more than loadFactor times the average keys
+func (b *Balancer) chooseAffinityPod(serviceKey string, key string, pods []model.PodInfo, annotations map[string]string) *model.PodInfo {
+	b.affinityMutex.Lock()
+	defer b.affinityMutex.Unlock()
+
+	if b.affinityKeys[serviceKey] == nil {
+		b.affinityKeys[serviceKey] = make(map[string]*affinityAssignment)
+		b.affinityLoads[serviceKey] = make(map[string]int)
+	}
+	assignments := b.affinityKeys[serviceKey]
+	loads := b.affinityLoads[serviceKey]
+
+	podIndex := make(map[string]int, len(pods))
+	for i := range pods {
+		podIndex[pods[i].IP] = i
+	}
+
+	if assignment, found := assignments[key]; found {
+		// expired keys are swept periodically, until then they are only ignored
+		if b.isAssignmentExpired(assignment) {
+			b.removeAssignment(serviceKey, key)
+		} else if i, valid := podIndex[assignment.podIP]; valid {
+			assignment.lastSeen = time.Now()
+			assignment.selections++
+			return &pods[i]
+		} else {
+			log.Println("Pod", assignment.podIP, "of key", key, "no longer satisfies QoS, rehashing")
+			b.removeAssignment(serviceKey, key)
+		}
+	}
+
+	loadFactor, err := strconv.ParseFloat(annotations["hashLoadFactor"], 64)
+	if err != nil || loadFactor < 1 {
+		loadFactor = defaultHashLoadFactor
+	}
+	capacity := int(math.Ceil(loadFactor * float64(len(assignments)+1) / float64(len(pods))))
+
+	table := b.getHashTable(serviceKey, pods, annotations["hashAlgorithm"])
+	preference := table.preference(key)
+	selectedIP := preference[0]
+	for _, podIP := range preference {
+		if loads[podIP] < capacity {
+			selectedIP = podIP
+			break
+		}
+	}
+
+	assignments[key] = &affinityAssignment{podIP: selectedIP, lastSeen: time.Now(), selections: 1}
+	loads[selectedIP]++
+	return &pods[podIndex[selectedIP]]
+}
+
+// cancelAffinityPod takes back a selection of the pod for the key, an assignment made for it is removed
+func (b *Balancer) cancelAffinityPod(serviceKey string, key string, podIP string) {
+	b.affinityMutex.Lock()
+	defer b.affinityMutex.Unlock()
+
+	assignment, found := b.affinityKeys[serviceKey][key]
+	if !found || assignment.podIP != podIP {
+		return
+	}
+
+	assignment.selections--
+	if assignment.selections <= 0 {
+		b.removeAssignment(serviceKey, key)
+	}
+}
+
+func (b *Balancer) isAssignmentExpired(assignment *affinityAssignment) bool {
+	return time.Since(assignment.lastSeen).Seconds() > float64(b.affinityTTLS)
+}
+
+// removeAssignment removes the assignment of a key and its share of the load of its pod, affinityMutex must be held
+func (b *Balancer) removeAssignment(serviceKey string, key string) {
+	assignment, found := b.affinityKeys[serviceKey][key]
+	if !found {
+		return
+	}
+
+	delete(b.affinityKeys[serviceKey], key)
+	loads := b.affinityLoads[serviceKey]
+	loads[assignment.podIP]--
+	if loads[assignment.podIP] <= 0 {
+		delete(loads, assignment.podIP)
+	}
+}
+
+// removeExpiredAssignments runs every affinitySweepIntervalS, it removes the keys without requests for
+// AFFINITY_TTL_S and the hash tables that were not used for as long
+func (b *Balancer) removeExpiredAssignments() {
+	b.affinityMutex.Lock()
+	defer b.affinityMutex.Unlock()
+
+	for serviceKey, assignments := range b.affinityKeys {
+		for key, assignment := range assignments {
+			if b.isAssignmentExpired(assignment) {
+				b.removeAssignment(serviceKey, key)
+			}
+		}
+		if len(assignments) == 0 {
+			delete(b.affinityKeys, serviceKey)
+			delete(b.affinityLoads, serviceKey)
+		}
+	}
+
+	for serviceKey, tables := range b.hashTables {
+		for tableKey, table := range tables {
+			if time.Since(table.lastUsed).Seconds() > float64(b.affinityTTLS) {
+				delete(tables, tableKey)
+			}
+		}
+		if len(tables) == 0 {
+			delete(b.hashTables, serviceKey)
+		}
+	}
+}
+
+// getHashTable returns the table of a service for the set of candidate pods, the tables of the last
+// maxHashTables sets are cached so a set the service returns to is not rebuilt
+func (b *Balancer) getHashTable(serviceKey string, pods []model.PodInfo, algorithm string) *hashTable {
+	if algorithm != hashAlgorithmMaglev {
+		algorithm = hashAlgorithmRing
+	}
+
+	podIPs := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		podIPs = append(podIPs, pod.IP)
+	}
+	sort.Strings(podIPs)
+	signature := strings.Join(podIPs, ",")
+	tableKey := hashString(algorithm + "/" + signature)
+
+	tables := b.hashTables[serviceKey]
+	if tables == nil {
+		tables = make(map[uint64]*hashTable)
+		b.hashTables[serviceKey] = tables
+	}
+	if table, found := tables[tableKey]; found && table.signature == signature && table.algorithm == algorithm {
+		table.lastUsed = time.Now()
+		return table
+	}
+
+	if len(tables) >= maxHashTables {
+		var oldestKey uint64
+		var oldest *hashTable
+		for key, table := range tables {
+			if oldest == nil || table.lastUsed.Before(oldest.lastUsed) {
+				oldestKey, oldest = key, table
+			}
+		}
+		delete(tables, oldestKey)
+	}
+
+	table := &hashTable{signature: signature, algorithm: algorithm, podIPs: podIPs, lastUsed: time.Now()}
+	if algorithm == hashAlgorithmMaglev {
+		table.buildMaglev()
+	} else {
+		table.buildRing()
+	}
+	tables[tableKey] = table
+
+	return table
+}
+
+func (t *hashTable) buildRing() {
+	type virtualNode struct {
+		hash uint64
+		pod  int
+	}
+
+	nodes := make([]virtualNode, 0, len(t.podIPs)*ringReplicas)
+	for pod, podIP := range t.podIPs {
+		for replica := 0; replica < ringReplicas; replica++ {
+			nodes = append(nodes, virtualNode{hash: hashString(podIP + "#" + strconv.Itoa(replica)), pod: pod})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].hash < nodes[j].hash
+	})
+
+	for _, node := range nodes {
+		t.ringHashes = append(t.ringHashes, node.hash)
+		t.ringPods = append(t.ringPods, node.pod)
+	}
+}
+
+// buildMaglev fills the lookup table as described in the Maglev paper, every pod takes turns claiming
+// the next free slot of its own permutation of the table
+func (t *hashTable) buildMaglev() {
+	podCount := len(t.podIPs)
+	offsets := make([]int, podCount)
+	skips := make([]int, podCount)
+	next := make([]int, podCount)
+	for pod, podIP := range t.podIPs {
+		offsets[pod], skips[pod] = getMaglevPermutation(podIP)
+	}
+
+	t.lookup = make([]int, maglevTableSize)
+	for i := range t.lookup {
+		t.lookup[i] = -1
+	}
+
+	for filled := 0; filled < maglevTableSize; {
+		for pod := 0; pod < podCount && filled < maglevTableSize; pod++ {
+			slot := (offsets[pod] + next[pod]*skips[pod]) % maglevTableSize
+			for t.lookup[slot] >= 0 {
+				next[pod]++
+				slot = (offsets[pod] + next[pod]*skips[pod]) % maglevTableSize
+			}
+
+			t.lookup[slot] = pod
+			next[pod]++
+			filled++
+		}
+	}
+}
+
+// getMaglevPermutation returns the offset and skip of the permutation of the table slots of a pod, the slot
+// tried j-th is (offset + j*skip) mod maglevTableSize, a permutation since the table size is prime
+func getMaglevPermutation(podIP string) (int, int) {
+	offset := int(hashString(podIP) % uint64(maglevTableSize))
+	skip := int(hashString(podIP+"#skip")%uint64(maglevTableSize-1)) + 1
+
+	return offset, skip
+}
+
+// preference returns all pods in the order they are tried for the key
+func (t *hashTable) preference(key string) []string {
+	keyHash := hashString(key)
+	seen := make(map[int]bool, len(t.podIPs))
+	result := make([]string, 0, len(t.podIPs))
+
+	add := func(pod int) {
+		if !seen[pod] {
+			seen[pod] = true
+			result = append(result, t.podIPs[pod])
+		}
+	}
+
+	if t.algorithm == hashAlgorithmMaglev {
+		start := int(keyHash % uint64(maglevTableSize))
+		for i := 0; i < maglevTableSize && len(result) < len(t.podIPs); i++ {
+			add(t.lookup[(start+i)%maglevTableSize])
+		}
+		return result
+	}
+
+	start := sort.Search(len(t.ringHashes), func(i int) bool {
+		return t.ringHashes[i] >= keyHash
+	})
+	for i := 0; i < len(t.ringHashes) && len(result) < len(t.podIPs); i++ {
+		add(t.ringPods[(start+i)%len(t.ringHashes)])
+	}
+
+	return result
+}
+
+func hashString(value string) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(value))
+
+	// fnv alone spreads similar strings (pod IPs, replica suffixes) poorly, finish with a 64 bit mixer
+	h := hash.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
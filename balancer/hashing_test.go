@@ -0,0 +1,345 @@
+package balancer
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+)
+
+func podIPs(count int) []string {
+	result := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		result = append(result, fmt.Sprintf("10.42.%d.%d", i/250, i%250+2))
+	}
+	return result
+}
+
+func newRingTable(podIPs []string) *hashTable {
+	table := &hashTable{algorithm: hashAlgorithmRing, podIPs: podIPs}
+	table.buildRing()
+	return table
+}
+
+func newAffinityBalancer() *Balancer {
+	return &Balancer{
+		affinityTTLS:  600,
+		affinityKeys:  make(map[string]map[string]*affinityAssignment),
+		affinityLoads: make(map[string]map[string]int),
+		hashTables:    make(map[string]map[uint64]*hashTable),
+		affinityMutex: &sync.Mutex{},
+	}
+}
+
+func podInfos(podIPs []string) []model.PodInfo {
+	pods := make([]model.PodInfo, 0, len(podIPs))
+	for _, podIP := range podIPs {
+		pods = append(pods, model.PodInfo{IP: podIP, HostIP: podIP})
+	}
+	return pods
+}
+
+func newMaglevTable(podIPs []string) *hashTable {
+	table := &hashTable{algorithm: hashAlgorithmMaglev, podIPs: podIPs}
+	table.buildMaglev()
+	return table
+}
+
+func TestMaglevPermutation(t *testing.T) {
+	for _, podIP := range []string{"10.42.0.2", "10.42.1.17", "10.42.3.250", "fd00::1"} {
+		t.Run(podIP, func(t *testing.T) {
+			offset, skip := getMaglevPermutation(podIP)
+			if offset < 0 || offset >= maglevTableSize {
+				t.Fatalf("offset %d out of range", offset)
+			}
+			if skip < 1 || skip >= maglevTableSize {
+				t.Fatalf("skip %d out of range", skip)
+			}
+
+			visited := make([]bool, maglevTableSize)
+			for j := 0; j < maglevTableSize; j++ {
+				slot := (offset + j*skip) % maglevTableSize
+				if visited[slot] {
+					t.Fatalf("slot %d visited twice", slot)
+				}
+				visited[slot] = true
+			}
+		})
+	}
+}
+
+func TestMaglevTableCoverage(t *testing.T) {
+	for _, podCount := range []int{1, 2, 3, 7, 10, 64} {
+		t.Run(fmt.Sprintf("%d pods", podCount), func(t *testing.T) {
+			table := newMaglevTable(podIPs(podCount))
+
+			slots := make([]int, podCount)
+			for slot, pod := range table.lookup {
+				if pod < 0 || pod >= podCount {
+					t.Fatalf("slot %d has pod %d", slot, pod)
+				}
+				slots[pod]++
+			}
+
+			// pods take turns claiming slots, so their shares differ by at most one slot
+			minSlots := maglevTableSize / podCount
+			for pod, count := range slots {
+				if count < minSlots || count > minSlots+1 {
+					t.Fatalf("pod %d has %d slots, want %d or %d", pod, count, minSlots, minSlots+1)
+				}
+			}
+
+			preference := table.preference("client-1")
+			if len(preference) != podCount {
+				t.Fatalf("preference has %d pods, want %d", len(preference), podCount)
+			}
+		})
+	}
+}
+
+func TestMaglevRemovalRemapping(t *testing.T) {
+	tests := []struct {
+		podCount int
+		removed  int
+		// share of the slots of the remaining pods that may move to another pod
+		maxMoved float64
+	}{
+		{podCount: 3, removed: 0, maxMoved: 0.02},
+		{podCount: 5, removed: 2, maxMoved: 0.02},
+		{podCount: 10, removed: 9, maxMoved: 0.02},
+		{podCount: 20, removed: 7, maxMoved: 0.02},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d pods without pod %d", test.podCount, test.removed), func(t *testing.T) {
+			before := podIPs(test.podCount)
+			after := append(append([]string{}, before[:test.removed]...), before[test.removed+1:]...)
+			tableBefore := newMaglevTable(before)
+			tableAfter := newMaglevTable(after)
+
+			kept := 0
+			moved := 0
+			for slot := range tableBefore.lookup {
+				podBefore := before[tableBefore.lookup[slot]]
+				podAfter := after[tableAfter.lookup[slot]]
+				if podBefore == before[test.removed] {
+					continue
+				}
+				kept++
+				if podBefore != podAfter {
+					moved++
+				}
+			}
+
+			if share := float64(moved) / float64(kept); share > test.maxMoved {
+				t.Fatalf("%.3f of the slots of the remaining pods moved, want at most %.3f", share, test.maxMoved)
+			}
+
+			// keys follow their slot, only those of the removed pod and of moved slots are remapped
+			keysKept := 0
+			keysMoved := 0
+			for i := 0; i < 10000; i++ {
+				key := fmt.Sprintf("client-%d", i)
+				podBefore := tableBefore.preference(key)[0]
+				podAfter := tableAfter.preference(key)[0]
+				if podAfter == before[test.removed] {
+					t.Fatalf("key %s mapped to the removed pod", key)
+				}
+				if podBefore == before[test.removed] {
+					continue
+				}
+				keysKept++
+				if podBefore != podAfter {
+					keysMoved++
+				}
+			}
+			if share := float64(keysMoved) / float64(keysKept); share > test.maxMoved {
+				t.Fatalf("%.3f of the keys of the remaining pods moved, want at most %.3f", share, test.maxMoved)
+			}
+		})
+	}
+}
+
+func TestRingPreference(t *testing.T) {
+	for _, podCount := range []int{1, 3, 10} {
+		t.Run(fmt.Sprintf("%d pods", podCount), func(t *testing.T) {
+			pods := podIPs(podCount)
+			table := newRingTable(pods)
+
+			keys := make(map[string]int)
+			for i := 0; i < 10000; i++ {
+				key := fmt.Sprintf("client-%d", i)
+				preference := table.preference(key)
+				if len(preference) != podCount {
+					t.Fatalf("preference of %s has %d pods, want %d", key, len(preference), podCount)
+				}
+				seen := make(map[string]bool)
+				for _, podIP := range preference {
+					if seen[podIP] {
+						t.Fatalf("preference of %s has %s twice", key, podIP)
+					}
+					seen[podIP] = true
+				}
+				if again := table.preference(key); again[0] != preference[0] {
+					t.Fatalf("key %s mapped to %s and %s", key, preference[0], again[0])
+				}
+				keys[preference[0]]++
+			}
+
+			// with ringReplicas virtual nodes each pod gets its share of the keys within a third
+			for _, podIP := range pods {
+				share := float64(keys[podIP]) * float64(podCount) / 10000
+				if math.Abs(share-1) > 0.33 {
+					t.Fatalf("pod %s got %.2f times its share of the keys", podIP, share)
+				}
+			}
+		})
+	}
+}
+
+func TestRingRemovalRemapping(t *testing.T) {
+	before := podIPs(10)
+	removed := before[4]
+	after := append(append([]string{}, before[:4]...), before[5:]...)
+	tableBefore := newRingTable(before)
+	tableAfter := newRingTable(after)
+
+	// on a ring only the keys of the removed pod move, to the pod they preferred next
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		preferenceBefore := tableBefore.preference(key)
+		podAfter := tableAfter.preference(key)[0]
+		want := preferenceBefore[0]
+		if want == removed {
+			want = preferenceBefore[1]
+		}
+		if podAfter != want {
+			t.Fatalf("key %s moved from %v to %s, want %s", key, preferenceBefore[:2], podAfter, want)
+		}
+	}
+}
+
+func TestBoundedLoad(t *testing.T) {
+	tests := []struct {
+		algorithm  string
+		loadFactor string
+		podCount   int
+		keyCount   int
+	}{
+		{algorithm: hashAlgorithmRing, loadFactor: "1", podCount: 4, keyCount: 1000},
+		{algorithm: hashAlgorithmRing, loadFactor: "1.25", podCount: 5, keyCount: 1000},
+		{algorithm: hashAlgorithmMaglev, loadFactor: "1", podCount: 3, keyCount: 1000},
+		{algorithm: hashAlgorithmMaglev, loadFactor: "1.5", podCount: 7, keyCount: 2000},
+		{algorithm: hashAlgorithmMaglev, loadFactor: "", podCount: 2, keyCount: 5},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %s %d pods", test.algorithm, test.loadFactor, test.podCount), func(t *testing.T) {
+			b := newAffinityBalancer()
+			pods := podInfos(podIPs(test.podCount))
+			annotations := map[string]string{"hashAlgorithm": test.algorithm, "hashLoadFactor": test.loadFactor}
+
+			loads := make(map[string]int)
+			for i := 0; i < test.keyCount; i++ {
+				loads[b.chooseAffinityPod("default/svc", fmt.Sprintf("client-%d", i), pods, annotations).IP]++
+			}
+
+			loadFactor := defaultHashLoadFactor
+			if test.loadFactor != "" {
+				fmt.Sscan(test.loadFactor, &loadFactor)
+			}
+			capacity := int(math.Ceil(loadFactor * float64(test.keyCount) / float64(test.podCount)))
+			for podIP, load := range loads {
+				if load > capacity {
+					t.Fatalf("pod %s has %d keys, capacity is %d", podIP, load, capacity)
+				}
+				if load != b.affinityLoads["default/svc"][podIP] {
+					t.Fatalf("pod %s has %d keys, tracked load is %d", podIP, load, b.affinityLoads["default/svc"][podIP])
+				}
+			}
+		})
+	}
+}
+
+func TestStickyReassignment(t *testing.T) {
+	for _, algorithm := range []string{hashAlgorithmRing, hashAlgorithmMaglev} {
+		t.Run(algorithm, func(t *testing.T) {
+			b := newAffinityBalancer()
+			allPods := podInfos(podIPs(4))
+			annotations := map[string]string{"hashAlgorithm": algorithm, "hashLoadFactor": "2"}
+
+			assigned := make(map[string]string)
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("client-%d", i)
+				assigned[key] = b.chooseAffinityPod("default/svc", key, allPods, annotations).IP
+			}
+
+			// the second pod drops out of the candidates, only its keys move
+			dropped := allPods[1].IP
+			remaining := []model.PodInfo{allPods[0], allPods[2], allPods[3]}
+			for key, podIP := range assigned {
+				newIP := b.chooseAffinityPod("default/svc", key, remaining, annotations).IP
+				if podIP != dropped && newIP != podIP {
+					t.Fatalf("key %s moved from %s to %s", key, podIP, newIP)
+				}
+				if newIP == dropped {
+					t.Fatalf("key %s stayed on the dropped pod", key)
+				}
+				assigned[key] = newIP
+			}
+
+			// the pod comes back, keys stay where they were reassigned
+			for key, podIP := range assigned {
+				if newIP := b.chooseAffinityPod("default/svc", key, allPods, annotations).IP; newIP != podIP {
+					t.Fatalf("key %s moved from %s to %s after the pod came back", key, podIP, newIP)
+				}
+			}
+			if load := b.affinityLoads["default/svc"][dropped]; load != 0 {
+				t.Fatalf("dropped pod still has a load of %d", load)
+			}
+
+			// expired keys are hashed again and removed by the sweep
+			for _, assignment := range b.affinityKeys["default/svc"] {
+				assignment.lastSeen = time.Now().Add(-time.Hour)
+			}
+			b.removeExpiredAssignments()
+			if len(b.affinityKeys) != 0 || len(b.affinityLoads) != 0 {
+				t.Fatalf("%d services with keys left after the sweep", len(b.affinityKeys))
+			}
+		})
+	}
+}
+
+func TestHashTableCache(t *testing.T) {
+	b := newAffinityBalancer()
+	allPods := podInfos(podIPs(3))
+	fewerPods := allPods[:2]
+
+	table := b.getHashTable("default/svc", allPods, hashAlgorithmMaglev)
+	other := b.getHashTable("default/svc", fewerPods, hashAlgorithmMaglev)
+	if table == other {
+		t.Fatal("different pod sets share a table")
+	}
+
+	// a pod toggling in and out of the candidates reuses the tables, in any order of the pods
+	reversed := []model.PodInfo{allPods[2], allPods[1], allPods[0]}
+	if again := b.getHashTable("default/svc", reversed, hashAlgorithmMaglev); again != table {
+		t.Fatal("table of a known pod set was rebuilt")
+	}
+	if again := b.getHashTable("default/svc", fewerPods, hashAlgorithmMaglev); again != other {
+		t.Fatal("table of a known pod set was rebuilt")
+	}
+	if ring := b.getHashTable("default/svc", allPods, hashAlgorithmRing); ring == table {
+		t.Fatal("ring and Maglev share a table")
+	}
+
+	for i := 0; i < 2*maxHashTables; i++ {
+		b.getHashTable("default/svc", podInfos(podIPs(i+4)), hashAlgorithmRing)
+	}
+	if count := len(b.hashTables["default/svc"]); count > maxHashTables {
+		t.Fatalf("%d tables cached, want at most %d", count, maxHashTables)
+	}
+}
@@ -0,0 +1,161 @@
+package balancer
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+)
+
+// baselineWindow is how long the minimum latency of a pod is kept as its baseline, at least one and at most two windows
+const baselineWindow = 60 * time.Second
+
+// AcquirePod counts a request that is being forwarded to the pod, it must be paired with ReleasePod
+func (b *Balancer) AcquirePod(podIP string) {
+	b.inFlightCounter(podIP).Add(1)
+}
+
+// ReleasePod counts a request to the pod as finished
+func (b *Balancer) ReleasePod(podIP string) {
+	b.inFlightCounter(podIP).Add(-1)
+}
+
+// GetInFlight returns the number of requests this proxy has open towards the pod
+func (b *Balancer) GetInFlight(podIP string) int64 {
+	b.inFlightMutex.Lock()
+	defer b.inFlightMutex.Unlock()
+
+	if counter, found := b.inFlight[podIP]; found {
+		return counter.Load()
+	}
+
+	return 0
+}
+
+// GetInFlightAll returns the number of requests in flight by pod IP, pods without requests are left out
+func (b *Balancer) GetInFlightAll() map[string]int64 {
+	b.inFlightMutex.Lock()
+	defer b.inFlightMutex.Unlock()
+
+	result := make(map[string]int64)
+	for podIP, counter := range b.inFlight {
+		if count := counter.Load(); count > 0 {
+			result[podIP] = count
+		}
+	}
+
+	return result
+}
+
+func (b *Balancer) inFlightCounter(podIP string) *atomic.Int64 {
+	b.inFlightMutex.Lock()
+	defer b.inFlightMutex.Unlock()
+
+	counter, found := b.inFlight[podIP]
+	if !found {
+		counter = &atomic.Int64{}
+		b.inFlight[podIP] = counter
+	}
+
+	return counter
+}
+
+// SetQueueWait records the time a request to the service waited for a concurrency slot, apart from the
+// upstream latency given to SetLatency
+func (b *Balancer) SetQueueWait(namespace string, service string, wait int) {
+	b.queueWaitMutex.Lock()
+	defer b.queueWaitMutex.Unlock()
+
+	serviceKey := model.ServiceKey(namespace, service)
+	if queueWait, found := b.queueWaits[serviceKey]; found {
+		b.queueWaits[serviceKey] = int((1-b.latencyWeight)*float64(queueWait) + b.latencyWeight*float64(wait))
+	} else {
+		b.queueWaits[serviceKey] = wait
+	}
+}
+
+// GetQueueWaits returns the average queue wait in milliseconds by service key
+func (b *Balancer) GetQueueWaits() map[string]int {
+	b.queueWaitMutex.Lock()
+	defer b.queueWaitMutex.Unlock()
+
+	result := make(map[string]int, len(b.queueWaits))
+	for serviceKey, queueWait := range b.queueWaits {
+		result[serviceKey] = queueWait
+	}
+
+	return result
+}
+
+// SetPodLatency records the latency of a successful request to the pod of the service for its baseline
+func (b *Balancer) SetPodLatency(namespace string, service string, podIP string, latency int) {
+	b.baselineMutex.Lock()
+	defer b.baselineMutex.Unlock()
+
+	key := model.ServiceKey(namespace, service) + "/" + podIP
+	window, found := b.baselines[key]
+	if !found {
+		window = &latencyWindow{current: -1, previous: -1}
+		b.baselines[key] = window
+	}
+	window.add(latency, time.Now())
+}
+
+// GetBaselineLatency returns the latency the pod of the service has without load, the minimum latency of its
+// requests over the last one to two baselineWindow. Unlike the latency the balancer keeps of the host, it does
+// not rise with the latency of loaded requests.
+func (b *Balancer) GetBaselineLatency(namespace string, service string, podIP string) (int, bool) {
+	b.baselineMutex.Lock()
+	defer b.baselineMutex.Unlock()
+
+	window, found := b.baselines[model.ServiceKey(namespace, service)+"/"+podIP]
+	if !found {
+		return 0, false
+	}
+
+	return window.min(time.Now())
+}
+
+// latencyWindow keeps the minimum latency of the current and the previous window, -1 if there was none
+type latencyWindow struct {
+	current      int
+	previous     int
+	currentStart time.Time
+}
+
+func (w *latencyWindow) add(latency int, now time.Time) {
+	w.rotate(now)
+	if w.current < 0 || latency < w.current {
+		w.current = latency
+	}
+}
+
+// min returns the minimum latency of both windows, at least 1 ms so faster requests still have a baseline
+func (w *latencyWindow) min(now time.Time) (int, bool) {
+	w.rotate(now)
+
+	minLatency := w.current
+	if minLatency < 0 || (w.previous >= 0 && w.previous < minLatency) {
+		minLatency = w.previous
+	}
+	if minLatency < 0 {
+		return 0, false
+	}
+
+	return int(math.Max(float64(minLatency), 1)), true
+}
+
+func (w *latencyWindow) rotate(now time.Time) {
+	elapsed := now.Sub(w.currentStart)
+	if elapsed < baselineWindow {
+		return
+	}
+
+	w.previous = w.current
+	if elapsed >= 2*baselineWindow {
+		w.previous = -1
+	}
+	w.current = -1
+	w.currentStart = now
+}
@@ -0,0 +1,44 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	type sample struct {
+		at      time.Duration
+		latency int
+	}
+
+	tests := []struct {
+		name     string
+		samples  []sample
+		at       time.Duration
+		want     int
+		wantSome bool
+	}{
+		{name: "no samples", at: 0},
+		{name: "minimum of the window", samples: []sample{{0, 40}, {time.Second, 12}, {2 * time.Second, 90}}, at: 3 * time.Second, want: 12, wantSome: true},
+		{name: "loaded latencies do not raise it", samples: []sample{{0, 10}, {10 * time.Second, 200}, {50 * time.Second, 300}, {70 * time.Second, 250}}, at: 80 * time.Second, want: 10, wantSome: true},
+		{name: "previous window is kept", samples: []sample{{0, 10}, {90 * time.Second, 30}}, at: 100 * time.Second, want: 10, wantSome: true},
+		{name: "older windows are dropped", samples: []sample{{0, 10}, {65 * time.Second, 30}, {130 * time.Second, 50}}, at: 140 * time.Second, want: 30, wantSome: true},
+		{name: "idle pod forgets its baseline", samples: []sample{{0, 10}}, at: 3 * baselineWindow},
+		{name: "sub-millisecond requests have a baseline of one", samples: []sample{{0, 0}}, at: time.Second, want: 1, wantSome: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			window := &latencyWindow{current: -1, previous: -1, currentStart: start}
+			for _, s := range test.samples {
+				window.add(s.latency, start.Add(s.at))
+			}
+
+			got, some := window.min(start.Add(test.at))
+			if got != test.want || some != test.wantSome {
+				t.Fatalf("got %d (%t), want %d (%t)", got, some, test.want, test.wantSome)
+			}
+		})
+	}
+}
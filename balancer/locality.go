@@ -0,0 +1,109 @@
+package balancer
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+)
+
+const (
+	localityNode   = "node"
+	localitySite   = "site"
+	localityZone   = "zone"
+	localityRegion = "region"
+	localityOther  = "other"
+)
+
+// parseLocalityWeights parses weights of the form "node=8,site=4,zone=2,region=2,other=1", missing tiers weigh 1,
+// an empty value disables topology aware routing
+func parseLocalityWeights(value string) map[string]float64 {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	weights := map[string]float64{
+		localityNode:   1,
+		localitySite:   1,
+		localityZone:   1,
+		localityRegion: 1,
+		localityOther:  1,
+	}
+	for _, entry := range strings.Split(value, ",") {
+		tier, weightValue, found := strings.Cut(strings.TrimSpace(entry), "=")
+		weight, err := strconv.ParseFloat(weightValue, 64)
+		if !found || err != nil || weight <= 0 {
+			continue
+		}
+		if _, known := weights[tier]; known {
+			weights[tier] = weight
+		}
+	}
+
+	return weights
+}
+
+// getLocalityWeights returns the weights of the localityWeights annotation, or the LOCALITY_WEIGHTS default
+func (b *Balancer) getLocalityWeights(annotations map[string]string) map[string]float64 {
+	if value, found := annotations["localityWeights"]; found {
+		return parseLocalityWeights(value)
+	}
+
+	return b.localityWeights
+}
+
+// getLocality returns the closest tier the node of a pod shares with the node of the proxy
+func (b *Balancer) getLocality(hostIP string, topology map[string]*model.NodeTopology) string {
+	if hostIP == b.ownIP {
+		return localityNode
+	}
+
+	own, pod := topology[b.ownIP], topology[hostIP]
+	if own == nil || pod == nil {
+		return localityOther
+	}
+
+	switch {
+	case own.Site != "" && own.Site == pod.Site:
+		return localitySite
+	case own.Zone != "" && own.Zone == pod.Zone:
+		return localityZone
+	case own.Region != "" && own.Region == pod.Region:
+		return localityRegion
+	}
+
+	return localityOther
+}
+
+// chooseByLocality picks a pod at random with a probability proportional to the weight of its locality
+func (b *Balancer) chooseByLocality(pods []model.PodInfo, weights map[string]float64) *model.PodInfo {
+	topology := b.k3sClient.GetNodesTopology()
+
+	total := 0.0
+	podWeights := make([]float64, len(pods))
+	for i := range pods {
+		podWeights[i] = weights[b.getLocality(pods[i].HostIP, topology)]
+		total += podWeights[i]
+	}
+
+	target := rand.Float64() * total
+	for i := range pods {
+		target -= podWeights[i]
+		if target < 0 {
+			return &pods[i]
+		}
+	}
+
+	return &pods[len(pods)-1]
+}
+
+// getLocalityLatency scales the latency of a pod down by the weight of its locality, so closer pods are
+// preferred unless a farther one is faster by more than the ratio of the weights
+func (b *Balancer) getLocalityLatency(latency int, hostIP string, weights map[string]float64, topology map[string]*model.NodeTopology) float64 {
+	if weights == nil {
+		return float64(latency)
+	}
+
+	return float64(latency) / weights[b.getLocality(hostIP, topology)]
+}
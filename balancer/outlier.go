@@ -0,0 +1,228 @@
+package balancer
+
+import (
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+const defaultOutlierIntervalS int = 10
+const defaultOutlierBaseEjectionS int = 30
+const defaultOutlierMaxEjectionPerc float64 = 0.5
+const defaultOutlierMinRequests int = 5
+const defaultOutlierStdevFactor float64 = 1.9
+const defaultOutlierLatencyFactor float64 = 3
+
+// outlier detection needs a population to compare with
+const outlierMinHosts int = 3
+
+type outlierStats struct {
+	requests int
+	failures int
+}
+
+type outlierEjection struct {
+	ejectedAt     time.Time
+	ejectionCount int
+	ejected       bool
+}
+
+// recordOutlier counts the outcome of a request to the service on the host for the current interval
+func (b *Balancer) recordOutlier(serviceKey string, hostIP string, success bool) {
+	b.outlierMutex.Lock()
+	defer b.outlierMutex.Unlock()
+
+	if b.outlierStats[serviceKey] == nil {
+		b.outlierStats[serviceKey] = make(map[string]*outlierStats)
+	}
+	stats := b.outlierStats[serviceKey][hostIP]
+	if stats == nil {
+		stats = &outlierStats{}
+		b.outlierStats[serviceKey][hostIP] = stats
+	}
+
+	stats.requests++
+	if !success {
+		stats.failures++
+	}
+}
+
+// isEjected reports whether the service on the host is ejected as an outlier
+func (b *Balancer) isEjected(serviceKey string, hostIP string) bool {
+	b.outlierMutex.Lock()
+	defer b.outlierMutex.Unlock()
+
+	ejection := b.ejections[serviceKey][hostIP]
+	return ejection != nil && ejection.ejected
+}
+
+// detectOutliers runs every OUTLIER_INTERVAL_S. A host is an outlier of a service when its success rate is more than
+// OUTLIER_STDEV_FACTOR standard deviations below the mean of the hosts of the service, or its latency is more than
+// OUTLIER_LATENCY_FACTOR times the median. Outliers are ejected for OUTLIER_BASE_EJECTION_S times the number of
+// times they were ejected, at most OUTLIER_MAX_EJECTION_PERC of the hosts and never more than the QoS minimum allows.
+func (b *Balancer) detectOutliers() {
+	latencies := b.getMeasuredLatencies()
+
+	b.outlierMutex.Lock()
+	defer b.outlierMutex.Unlock()
+
+	for serviceKey, ejections := range b.ejections {
+		for hostIP, ejection := range ejections {
+			if ejection.ejected && time.Since(ejection.ejectedAt) >= b.getEjectionDuration(ejection) {
+				log.Println("Outlier", hostIP, "of service", serviceKey, "is no longer ejected")
+				ejection.ejected = false
+			}
+		}
+	}
+
+	for serviceKey, hostStats := range b.outlierStats {
+		if b.ejections[serviceKey] == nil {
+			b.ejections[serviceKey] = make(map[string]*outlierEjection)
+		}
+		ejections := b.ejections[serviceKey]
+
+		outliers := b.findOutliers(serviceKey, hostStats, latencies[serviceKey])
+
+		hostCount := len(hostStats)
+		ejectedCount := 0
+		for hostIP, ejection := range ejections {
+			if _, found := hostStats[hostIP]; !found && ejection.ejected {
+				hostCount++
+			}
+			if ejection.ejected {
+				ejectedCount++
+			}
+		}
+		maxEjected := int(float64(hostCount) * math.Min(b.outlierMaxEjectionPerc, 1-b.qosPercentage))
+
+		for hostIP := range hostStats {
+			ejection := ejections[hostIP]
+			if ejection == nil {
+				ejection = &outlierEjection{}
+				ejections[hostIP] = ejection
+			}
+
+			if !outliers[hostIP] {
+				// hosts that behave lose their ejection history one interval at a time
+				if !ejection.ejected && ejection.ejectionCount > 0 {
+					ejection.ejectionCount--
+				}
+				continue
+			}
+			if ejection.ejected {
+				continue
+			}
+			if ejectedCount >= maxEjected {
+				log.Println("Outlier", hostIP, "of service", serviceKey, "is not ejected, max ejection percentage reached")
+				continue
+			}
+
+			ejection.ejected = true
+			ejection.ejectedAt = time.Now()
+			ejection.ejectionCount++
+			ejectedCount++
+			log.Println("Outlier", hostIP, "of service", serviceKey, "is ejected for", b.getEjectionDuration(ejection))
+		}
+	}
+
+	b.outlierStats = make(map[string]map[string]*outlierStats)
+}
+
+// findOutliers returns the hosts of the service whose success rate or latency stands out from the other hosts
+func (b *Balancer) findOutliers(serviceKey string, hostStats map[string]*outlierStats, hostLatencies map[string]int) map[string]bool {
+	outliers := make(map[string]bool)
+
+	successRates := make(map[string]float64)
+	for hostIP, stats := range hostStats {
+		if stats.requests >= b.outlierMinRequests {
+			successRates[hostIP] = float64(stats.requests-stats.failures) / float64(stats.requests)
+		}
+	}
+	if len(successRates) >= outlierMinHosts {
+		mean := 0.0
+		for _, rate := range successRates {
+			mean += rate
+		}
+		mean /= float64(len(successRates))
+
+		variance := 0.0
+		for _, rate := range successRates {
+			variance += (rate - mean) * (rate - mean)
+		}
+		stdev := math.Sqrt(variance / float64(len(successRates)))
+
+		for hostIP, rate := range successRates {
+			if rate < mean-b.outlierStdevFactor*stdev {
+				log.Println("Host", hostIP, "of service", serviceKey, "is a success rate outlier ::", rate, "mean", mean)
+				outliers[hostIP] = true
+			}
+		}
+	}
+
+	latencies := make(map[string]int)
+	for hostIP := range hostStats {
+		if latency, found := hostLatencies[hostIP]; found {
+			latencies[hostIP] = latency
+		}
+	}
+	if len(latencies) >= outlierMinHosts {
+		sorted := make([]int, 0, len(latencies))
+		for _, latency := range latencies {
+			sorted = append(sorted, latency)
+		}
+		sort.Ints(sorted)
+		median := float64(sorted[len(sorted)/2])
+
+		for hostIP, latency := range latencies {
+			if median > 0 && float64(latency) > b.outlierLatencyFactor*median {
+				log.Println("Host", hostIP, "of service", serviceKey, "is a latency outlier ::", latency, "median", median)
+				outliers[hostIP] = true
+			}
+		}
+	}
+
+	return outliers
+}
+
+// getMeasuredLatencies returns the latencies that were measured, not approximated, by service key and host IP
+func (b *Balancer) getMeasuredLatencies() map[string]map[string]int {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+
+	result := make(map[string]map[string]int)
+	for hostIP, services := range b.hostLatency {
+		for serviceKey, serviceStatus := range services {
+			if serviceStatus.IsApproximated {
+				continue
+			}
+			if result[serviceKey] == nil {
+				result[serviceKey] = make(map[string]int)
+			}
+			result[serviceKey][hostIP] = serviceStatus.Latency
+		}
+	}
+
+	return result
+}
+
+func (b *Balancer) getEjectionDuration(ejection *outlierEjection) time.Duration {
+	return time.Duration(b.outlierBaseEjectionS*ejection.ejectionCount) * time.Second
+}
+
+// GetEjectedHosts returns the ejected hosts by service key
+func (b *Balancer) GetEjectedHosts() map[string][]string {
+	b.outlierMutex.Lock()
+	defer b.outlierMutex.Unlock()
+
+	result := make(map[string][]string)
+	for serviceKey, ejections := range b.ejections {
+		for hostIP, ejection := range ejections {
+			if ejection.ejected {
+				result[serviceKey] = append(result[serviceKey], hostIP)
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,128 @@
+package balancer
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+)
+
+const (
+	scoreLatency  = "latency"
+	scoreCpu      = "cpu"
+	scoreRam      = "ram"
+	scoreFailures = "failures"
+	scoreLocality = "locality"
+	scoreInFlight = "inflight"
+)
+
+const defaultScoreWeights string = "latency=1,cpu=0.5,ram=0.5,failures=0.5,locality=0.5,inflight=0.5"
+
+// minScore keeps every candidate selectable, so a pod with the worst score in every objective still gets some traffic
+const minScore float64 = 0.01
+
+// parseScoreWeights parses weights of the form "latency=1,cpu=0.5", objectives that are not listed weigh 0
+func parseScoreWeights(value string) map[string]float64 {
+	weights := map[string]float64{
+		scoreLatency:  0,
+		scoreCpu:      0,
+		scoreRam:      0,
+		scoreFailures: 0,
+		scoreLocality: 0,
+		scoreInFlight: 0,
+	}
+	for _, entry := range strings.Split(value, ",") {
+		objective, weightValue, found := strings.Cut(strings.TrimSpace(entry), "=")
+		weight, err := strconv.ParseFloat(weightValue, 64)
+		if !found || err != nil || weight < 0 {
+			continue
+		}
+		if _, known := weights[objective]; known {
+			weights[objective] = weight
+		}
+	}
+
+	return weights
+}
+
+// getScoreWeights returns the weights of the scoreWeights annotation, or the SCORE_WEIGHTS default
+func (b *Balancer) getScoreWeights(annotations map[string]string) map[string]float64 {
+	if value, found := annotations["scoreWeights"]; found {
+		return parseScoreWeights(value)
+	}
+
+	return b.scoreWeights
+}
+
+// chooseByScore picks a pod at random with a probability proportional to its score. Every objective is
+// normalized to [0, 1] where 0 is best, the score is one minus the weighted average of the objectives
+func (b *Balancer) chooseByScore(serviceKey string, pods []model.PodInfo, annotations map[string]string, nodeStatus map[string]*model.NodeMetrics, maxLatency int) *model.PodInfo {
+	weights := b.getScoreWeights(annotations)
+	localityWeights := b.getLocalityWeights(annotations)
+	topology := b.k3sClient.GetNodesTopology()
+
+	maxLocalityWeight := 0.0
+	for _, weight := range localityWeights {
+		maxLocalityWeight = math.Max(maxLocalityWeight, weight)
+	}
+
+	maxInFlight := int64(0)
+	inFlight := make([]int64, len(pods))
+	for i := range pods {
+		inFlight[i] = b.GetInFlight(pods[i].IP)
+		if inFlight[i] > maxInFlight {
+			maxInFlight = inFlight[i]
+		}
+	}
+
+	totalWeight := 0.0
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+
+	total := 0.0
+	scores := make([]float64, len(pods))
+	for i := range pods {
+		objectives := make(map[string]float64)
+
+		if serviceStatus := b.hostLatency[pods[i].HostIP][serviceKey]; serviceStatus != nil {
+			objectives[scoreLatency] = math.Min(float64(serviceStatus.Latency)/float64(maxLatency), 1)
+			objectives[scoreFailures] = float64(serviceStatus.FailedReqCounter) / float64(serviceStatus.FailedReqCounter+1)
+		}
+		if nodeStatus[pods[i].HostIP] != nil {
+			objectives[scoreCpu] = math.Min(nodeStatus[pods[i].HostIP].CpuUsage, 1)
+			objectives[scoreRam] = math.Min(nodeStatus[pods[i].HostIP].RamUsage, 1)
+		}
+		if localityWeights != nil {
+			objectives[scoreLocality] = 1 - localityWeights[b.getLocality(pods[i].HostIP, topology)]/maxLocalityWeight
+		}
+		if maxInFlight > 0 {
+			objectives[scoreInFlight] = float64(inFlight[i]) / float64(maxInFlight)
+		}
+
+		cost := 0.0
+		for objective, weight := range weights {
+			cost += weight * objectives[objective]
+		}
+		if totalWeight > 0 {
+			cost /= totalWeight
+		}
+
+		scores[i] = math.Max(1-cost, minScore)
+		total += scores[i]
+		log.Println("Score of pod", pods[i].IP, "::", scores[i])
+	}
+
+	target := rand.Float64() * total
+	for i := range pods {
+		target -= scores[i]
+		if target < 0 {
+			return &pods[i]
+		}
+	}
+
+	return &pods[len(pods)-1]
+}
@@ -0,0 +1,250 @@
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+)
+
+// stateVersion is increased on incompatible changes of the state file, files of other versions are ignored
+const stateVersion int = 1
+
+const defaultStateSnapshotS int = 60
+const defaultStateMaxAgeS int = 600
+
+type stateSnapshot struct {
+	Version       int                                  `json:"version"`
+	SavedAt       time.Time                            `json:"savedAt"`
+	HostLatency   map[string]map[string]*hostState     `json:"hostLatency"`
+	HostPingCache map[string]*pingState                `json:"hostPingCache"`
+	Breakers      map[string]*breakerState             `json:"breakers,omitempty"`
+	Ejections     map[string]map[string]*ejectionState `json:"ejections,omitempty"`
+}
+
+type hostState struct {
+	Latency          int       `json:"latency"`
+	IsServiceHealthy bool      `json:"isServiceHealthy"`
+	IsApproximated   bool      `json:"isApproximated"`
+	FailedReqCounter int       `json:"failedReqCounter"`
+	ReqTime          time.Time `json:"reqTime"`
+}
+
+// breakerState is the circuit breaker of a service on a host, keyed like Balancer.breakers. The outcome window and
+// the trials are not kept, a half-open breaker is saved as open and becomes half-open again on its next request.
+type breakerState struct {
+	State     string    `json:"state"`
+	OpenedAt  time.Time `json:"openedAt"`
+	OpenCount int       `json:"openCount"`
+}
+
+type ejectionState struct {
+	Ejected       bool      `json:"ejected"`
+	EjectedAt     time.Time `json:"ejectedAt"`
+	EjectionCount int       `json:"ejectionCount"`
+}
+
+type pingState struct {
+	Latency   int       `json:"latency"`
+	CacheTime time.Time `json:"cacheTime"`
+}
+
+// SaveState writes the learned latencies, failure counters, ping cache, circuit breakers and outlier ejections to
+// path, replacing the file atomically
+func (b *Balancer) SaveState(path string) error {
+	snapshot := &stateSnapshot{
+		Version:       stateVersion,
+		SavedAt:       time.Now(),
+		HostLatency:   make(map[string]map[string]*hostState),
+		HostPingCache: make(map[string]*pingState),
+		Breakers:      make(map[string]*breakerState),
+		Ejections:     make(map[string]map[string]*ejectionState),
+	}
+
+	b.stateMutex.Lock()
+	for hostIP, services := range b.hostLatency {
+		snapshot.HostLatency[hostIP] = make(map[string]*hostState, len(services))
+		for serviceKey, serviceStatus := range services {
+			snapshot.HostLatency[hostIP][serviceKey] = &hostState{
+				Latency:          serviceStatus.Latency,
+				IsServiceHealthy: serviceStatus.IsServiceHealthy,
+				IsApproximated:   serviceStatus.IsApproximated,
+				FailedReqCounter: serviceStatus.FailedReqCounter,
+				ReqTime:          serviceStatus.ReqTime,
+			}
+		}
+	}
+	for hostIP, pingCache := range b.hostPingCache {
+		snapshot.HostPingCache[hostIP] = &pingState{
+			Latency:   pingCache.Latency,
+			CacheTime: pingCache.CacheTime,
+		}
+	}
+	b.stateMutex.Unlock()
+
+	b.breakerMutex.Lock()
+	for key, breaker := range b.breakers {
+		if breaker.state == breakerClosed && breaker.openCount == 0 {
+			continue
+		}
+		state := breaker.state
+		if state == breakerHalfOpen {
+			state = breakerOpen
+		}
+		snapshot.Breakers[key] = &breakerState{
+			State:     state,
+			OpenedAt:  breaker.openedAt,
+			OpenCount: breaker.openCount,
+		}
+	}
+	b.breakerMutex.Unlock()
+
+	b.outlierMutex.Lock()
+	for serviceKey, ejections := range b.ejections {
+		for hostIP, ejection := range ejections {
+			if !ejection.ejected && ejection.ejectionCount == 0 {
+				continue
+			}
+			if snapshot.Ejections[serviceKey] == nil {
+				snapshot.Ejections[serviceKey] = make(map[string]*ejectionState)
+			}
+			snapshot.Ejections[serviceKey][hostIP] = &ejectionState{
+				Ejected:       ejection.ejected,
+				EjectedAt:     ejection.ejectedAt,
+				EjectionCount: ejection.ejectionCount,
+			}
+		}
+	}
+	b.outlierMutex.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// RestoreState reads the state saved by SaveState. A file older than maxAge is ignored, as are latencies
+// measured and pings cached longer than maxAge before. Restored latencies count as approximated, so they
+// give way to the first measurements. Circuit breakers and ejections are restored as saved, their open and ejection
+// durations keep running from the time they were opened or ejected.
+func (b *Balancer) RestoreState(path string, maxAge time.Duration) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Println("No state to restore at", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	snapshot := &stateSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", snapshot.Version)
+	}
+	if time.Since(snapshot.SavedAt) > maxAge {
+		log.Println("State at", path, "is stale, saved at", snapshot.SavedAt)
+		return nil
+	}
+
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+
+	b.restoreBreakers(snapshot.Breakers)
+	b.restoreEjections(snapshot.Ejections)
+
+	restored := 0
+	for hostIP, services := range snapshot.HostLatency {
+		for serviceKey, serviceStatus := range services {
+			if time.Since(serviceStatus.ReqTime) > maxAge {
+				continue
+			}
+
+			if b.hostLatency[hostIP] == nil {
+				b.hostLatency[hostIP] = make(map[string]*model.HostData)
+			}
+			b.hostLatency[hostIP][serviceKey] = &model.HostData{
+				Latency:          serviceStatus.Latency,
+				IsServiceHealthy: serviceStatus.IsServiceHealthy,
+				IsApproximated:   true,
+				FailedReqCounter: serviceStatus.FailedReqCounter,
+				ReqTime:          serviceStatus.ReqTime,
+			}
+			restored++
+		}
+	}
+	for hostIP, pingCache := range snapshot.HostPingCache {
+		if time.Since(pingCache.CacheTime) <= maxAge {
+			b.hostPingCache[hostIP] = &model.PingCache{
+				Latency:   pingCache.Latency,
+				CacheTime: pingCache.CacheTime,
+			}
+		}
+	}
+
+	log.Println("Restored", restored, "latencies from", path, "saved at", snapshot.SavedAt)
+	return nil
+}
+
+func (b *Balancer) restoreBreakers(breakers map[string]*breakerState) {
+	b.breakerMutex.Lock()
+	defer b.breakerMutex.Unlock()
+
+	for key, state := range breakers {
+		if state.State != breakerClosed && state.State != breakerOpen {
+			continue
+		}
+		b.breakers[key] = &circuitBreaker{
+			state:     state.State,
+			outcomes:  make([]bool, b.breakerWindow),
+			openedAt:  state.OpenedAt,
+			openCount: state.OpenCount,
+		}
+	}
+}
+
+func (b *Balancer) restoreEjections(ejections map[string]map[string]*ejectionState) {
+	b.outlierMutex.Lock()
+	defer b.outlierMutex.Unlock()
+
+	for serviceKey, hosts := range ejections {
+		for hostIP, state := range hosts {
+			if b.ejections[serviceKey] == nil {
+				b.ejections[serviceKey] = make(map[string]*outlierEjection)
+			}
+			b.ejections[serviceKey][hostIP] = &outlierEjection{
+				ejected:       state.Ejected,
+				ejectedAt:     state.EjectedAt,
+				ejectionCount: state.EjectionCount,
+			}
+		}
+	}
+}
+
+func (b *Balancer) saveState() {
+	if err := b.SaveState(b.stateFile); err != nil {
+		log.Println("Failed to save state to", b.stateFile, "::", err)
+	}
+}
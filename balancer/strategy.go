@@ -0,0 +1,94 @@
+package balancer
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+)
+
+const (
+	strategyRandom   = "random"
+	strategyLatency  = "latency"
+	strategyScore    = "score"
+	strategyUCB      = "ucb"
+	strategyThompson = "thompson"
+
+	strategyLeastRequest = "least-request"
+	strategyLatencyLoad  = "latency-load"
+)
+
+var strategies = map[string]bool{
+	strategyRandom:   true,
+	strategyLatency:  true,
+	strategyScore:    true,
+	strategyUCB:      true,
+	strategyThompson: true,
+
+	strategyLeastRequest: true,
+	strategyLatencyLoad:  true,
+}
+
+// getStrategy returns the strategy of the strategy annotation, or the STRATEGY default
+func (b *Balancer) getStrategy(annotations map[string]string) string {
+	if strategy := annotations["strategy"]; strategies[strategy] {
+		return strategy
+	}
+
+	return b.strategy
+}
+
+// selectPod selects one of the candidate pods that satisfy QoS with the given strategy
+func (b *Balancer) selectPod(strategy string, serviceKey string, pods []model.PodInfo, annotations map[string]string, nodeStatus map[string]*model.NodeMetrics, maxLatency int) *model.PodInfo {
+	localityWeights := b.getLocalityWeights(annotations)
+
+	switch {
+	case strategy == strategyScore:
+		log.Println("Choosing a Pod IP weighted by score from the list that satisify QoS")
+		return b.chooseByScore(serviceKey, pods, annotations, nodeStatus, maxLatency)
+	case strategy == strategyRandom && localityWeights != nil:
+		log.Println("Choosing a Pod IP weighted by locality from the list that satisify QoS")
+		return b.chooseByLocality(pods, localityWeights)
+	case strategy == strategyLeastRequest:
+		log.Println("Choosing the Pod IP with the least requests in flight from the list that satisify QoS")
+		return b.chooseByLoad(serviceKey, pods, false)
+	case strategy == strategyLatencyLoad:
+		log.Println("Choosing the Pod IP with the lowest latency times load from the list that satisify QoS")
+		return b.chooseByLoad(serviceKey, pods, true)
+	case strategy == strategyRandom:
+		log.Println("Choosing a random Pod IP from the list that satisify QoS")
+		return &pods[rand.Intn(len(pods))]
+	}
+
+	topology := b.k3sClient.GetNodesTopology()
+	sort.SliceStable(pods, func(i, j int) bool {
+		return b.getLocalityLatency(b.hostLatency[pods[i].HostIP][serviceKey].Latency, pods[i].HostIP, localityWeights, topology) <
+			b.getLocalityLatency(b.hostLatency[pods[j].HostIP][serviceKey].Latency, pods[j].HostIP, localityWeights, topology)
+	})
+
+	log.Println("Selected a pod based on Node resource usage and latency")
+	return &pods[0]
+}
+
+// chooseByLoad picks the pod with the least requests in flight, or with withLatency the lowest latency multiplied
+// by the requests in flight including the new one, ties are broken at random
+func (b *Balancer) chooseByLoad(serviceKey string, pods []model.PodInfo, withLatency bool) *model.PodInfo {
+	var selectedPods []*model.PodInfo
+	bestCost := 0.0
+	for i := range pods {
+		cost := float64(b.GetInFlight(pods[i].IP) + 1)
+		if withLatency {
+			cost *= float64(b.hostLatency[pods[i].HostIP][serviceKey].Latency + 1)
+		}
+
+		if len(selectedPods) == 0 || cost < bestCost {
+			selectedPods = []*model.PodInfo{&pods[i]}
+			bestCost = cost
+		} else if cost == bestCost {
+			selectedPods = append(selectedPods, &pods[i])
+		}
+	}
+
+	return selectedPods[rand.Intn(len(selectedPods))]
+}
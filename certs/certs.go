@@ -0,0 +1,181 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Store struct {
+	mutex *sync.RWMutex
+
+	// certificates by their source (e.g. namespace/secret) and by the DNS names they are valid for
+	sourceCertificates map[string]*tls.Certificate
+	nameCertificates   map[string]*tls.Certificate
+	defaultCertificate *tls.Certificate
+
+	clientCAs *x509.CertPool
+}
+
+func NewStore() *Store {
+	return &Store{
+		mutex:              &sync.RWMutex{},
+		sourceCertificates: make(map[string]*tls.Certificate),
+		nameCertificates:   make(map[string]*tls.Certificate),
+	}
+}
+
+func (s *Store) LoadDefaultCertificate(certFile string, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaultCertificate = &certificate
+
+	return nil
+}
+
+// SetCertificate adds or replaces the certificate of a source, it is served for the DNS names of its leaf certificate
+func (s *Store) SetCertificate(source string, certPEM []byte, keyPEM []byte) error {
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	certificate.Leaf = leaf
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sourceCertificates[source] = &certificate
+	s.rebuildNames()
+	log.Println("Loaded certificate", source, "for", getNames(leaf))
+
+	return nil
+}
+
+func (s *Store) DeleteCertificate(source string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, found := s.sourceCertificates[source]; !found {
+		return
+	}
+
+	delete(s.sourceCertificates, source)
+	s.rebuildNames()
+	log.Println("Removed certificate", source)
+}
+
+// SetClientCAs replaces the CA bundle used to verify client certificates
+func (s *Store) SetClientCAs(caPEM []byte) error {
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in client CA bundle")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clientCAs = clientCAs
+	log.Println("Loaded client CA bundle")
+
+	return nil
+}
+
+// GetCertificate selects a certificate by SNI, exact names before wildcards, falling back to the default certificate
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	serverName := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if certificate, found := s.nameCertificates[serverName]; found {
+		return certificate, nil
+	}
+
+	if _, domain, found := strings.Cut(serverName, "."); found {
+		if certificate, found := s.nameCertificates["*."+domain]; found {
+			return certificate, nil
+		}
+	}
+
+	if s.defaultCertificate != nil {
+		return s.defaultCertificate, nil
+	}
+
+	return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+}
+
+// TLSConfig returns a config that always uses the current certificates and client CAs, so reloads apply to new handshakes
+func (s *Store) TLSConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mutex.RLock()
+			clientCAs := s.clientCAs
+			s.mutex.RUnlock()
+
+			return &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				NextProtos:     []string{"h2", "http/1.1"},
+				GetCertificate: s.GetCertificate,
+				ClientAuth:     clientAuth,
+				ClientCAs:      clientCAs,
+			}, nil
+		},
+	}
+}
+
+// ParseClientAuth maps none, optional and require to the client certificate verification modes
+func ParseClientAuth(value string) (tls.ClientAuthType, error) {
+	switch value {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+
+	return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q", value)
+}
+
+func (s *Store) rebuildNames() {
+	// sources are applied in order so that the same name always resolves to the same certificate
+	sources := make([]string, 0, len(s.sourceCertificates))
+	for source := range s.sourceCertificates {
+		sources = append(sources, source)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sources)))
+
+	nameCertificates := make(map[string]*tls.Certificate)
+	for _, source := range sources {
+		certificate := s.sourceCertificates[source]
+		for _, name := range getNames(certificate.Leaf) {
+			nameCertificates[strings.ToLower(name)] = certificate
+		}
+	}
+
+	s.nameCertificates = nameCertificates
+}
+
+func getNames(leaf *x509.Certificate) []string {
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames
+	}
+	if leaf.Subject.CommonName != "" {
+		return []string{leaf.Subject.CommonName}
+	}
+
+	return nil
+}
@@ -0,0 +1,422 @@
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/balancer"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/stream"
+)
+
+const (
+	typeConfirmable    byte = 0
+	typeNonConfirmable byte = 1
+	typeAcknowledgment byte = 2
+	typeReset          byte = 3
+)
+
+// transmission parameters from RFC 7252, section 4.8
+const defaultAckTimeoutMs int = 2000
+const ackRandomFactor float64 = 1.5
+const defaultMaxRetransmit int = 4
+const exchangeLifetime = 247 * time.Second
+
+const defaultIdleTimeoutS int = 300
+const maxMessageSize int = 64 * 1024
+const maxPendingMessages int = 16
+
+// podBalancer chooses the pods of flows and learns from the exchanges, implemented by balancer.Balancer
+type podBalancer interface {
+	ChoosePodForKey(namespace string, service string, portName string, key string) (string, string, string)
+	SetLatency(hostIP string, latency int, namespace string, service string)
+	SetReqFailed(hostIP string, namespace string, service string)
+}
+
+type Proxy struct {
+	balancer podBalancer
+
+	ackTimeoutMs  int
+	maxRetransmit int
+	idleTimeoutS  int
+
+	// flows in progress
+	sessions stream.Sessions
+}
+
+// udpListener is the socket of a CoAP listener and the flows of its clients, once closed it takes no new
+// clients and flows end after being idle for the ACK timeout, the socket stays open to answer them
+type udpListener struct {
+	conn         *net.UDPConn
+	flows        *sync.Map
+	closed       atomic.Bool
+	drainTimeout time.Duration
+}
+
+// flow binds a client endpoint to a pod, each flow has its own upstream socket so message IDs of
+// different clients can not collide. Until the pod is chosen the messages of the client are pending.
+type flow struct {
+	mutex        *sync.Mutex
+	upstreamConn *net.UDPConn
+	hostIP       string
+	exchanges    map[uint16]*exchange
+	pending      [][]byte
+}
+
+// exchange is a confirmable message from the client waiting for, or deduplicated by, the pod's ACK/RST
+type exchange struct {
+	message     []byte
+	sentTime    time.Time
+	retransmits int
+	timer       *time.Timer
+	response    []byte
+	expires     time.Time
+}
+
+func NewProxy(edgeBalancer *balancer.Balancer) *Proxy {
+	ackTimeoutMs, err := strconv.Atoi(os.Getenv("COAP_ACK_TIMEOUT_MS"))
+	if err != nil {
+		ackTimeoutMs = defaultAckTimeoutMs
+	}
+	log.Println("COAP_ACK_TIMEOUT_MS:", ackTimeoutMs)
+
+	maxRetransmit, err := strconv.Atoi(os.Getenv("COAP_MAX_RETRANSMIT"))
+	if err != nil {
+		maxRetransmit = defaultMaxRetransmit
+	}
+	log.Println("COAP_MAX_RETRANSMIT:", maxRetransmit)
+
+	idleTimeoutS, err := strconv.Atoi(os.Getenv("COAP_IDLE_TIMEOUT_S"))
+	if err != nil {
+		idleTimeoutS = defaultIdleTimeoutS
+	}
+	log.Println("COAP_IDLE_TIMEOUT_S:", idleTimeoutS)
+
+	return &Proxy{
+		balancer:      edgeBalancer,
+		ackTimeoutMs:  ackTimeoutMs,
+		maxRetransmit: maxRetransmit,
+		idleTimeoutS:  idleTimeoutS,
+	}
+}
+
+// Serve starts serving the listener, closing the returned listener stops taking new clients while the flows
+// in progress go on, see Wait
+func (p *Proxy) Serve(listener *stream.ListenerConfig) (io.Closer, error) {
+	listenAddr, err := net.ResolveUDPAddr("udp", ":"+listener.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	listenConn, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Starting CoAP proxy at port", listener.Port, "for service", listener.Namespace+"/"+listener.Service)
+
+	udp := &udpListener{conn: listenConn, flows: &sync.Map{}, drainTimeout: time.Duration(p.ackTimeoutMs) * time.Millisecond}
+	go func() {
+		if err := p.read(udp, listener); err != nil {
+			log.Println("CoAP proxy at port", listener.Port, "stopped ::", err)
+		}
+	}()
+
+	return udp, nil
+}
+
+// Wait waits until the flows in progress ended, new ones are no longer started
+func (p *Proxy) Wait() {
+	p.sessions.Wait()
+}
+
+func (p *Proxy) read(udp *udpListener, listener *stream.ListenerConfig) error {
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, clientAddr, err := udp.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return err
+		}
+		if !isValidMessage(buffer[:n]) {
+			continue
+		}
+
+		flowData, found := udp.flows.Load(clientAddr.String())
+		if !found {
+			if udp.closed.Load() || !p.sessions.Start() {
+				continue
+			}
+
+			newFlow := &flow{mutex: &sync.Mutex{}, exchanges: make(map[uint16]*exchange)}
+			flowData = newFlow
+			udp.flows.Store(clientAddr.String(), newFlow)
+			go func() {
+				defer p.sessions.Done()
+				p.openFlow(udp, clientAddr, newFlow, listener)
+			}()
+		}
+
+		message := make([]byte, n)
+		copy(message, buffer[:n])
+		p.handleClientMessage(udp.conn, clientAddr, flowData.(*flow), message, listener)
+	}
+}
+
+// openFlow chooses the pod of a new client off the read loop, forwards the messages that arrived in the meantime
+// and relays the messages of the pod
+func (p *Proxy) openFlow(udp *udpListener, clientAddr *net.UDPAddr, clientFlow *flow, listener *stream.ListenerConfig) {
+	upstreamConn, hostIP := p.dialPod(listener, clientAddr)
+	if upstreamConn == nil {
+		udp.flows.Delete(clientAddr.String())
+		return
+	}
+
+	// pending messages are forwarded under the lock, so they stay ahead of the messages the read loop forwards next
+	clientFlow.mutex.Lock()
+	clientFlow.upstreamConn = upstreamConn
+	clientFlow.hostIP = hostIP
+	for _, message := range clientFlow.pending {
+		if p.trackClientMessage(udp.conn, clientAddr, clientFlow, message, listener) {
+			if _, err := upstreamConn.Write(message); err != nil {
+				log.Println("CoAP: Failed to forward message to pod ::", err)
+			}
+		}
+	}
+	clientFlow.pending = nil
+	clientFlow.mutex.Unlock()
+
+	p.readFlow(udp, clientAddr, clientFlow, listener)
+}
+
+func (p *Proxy) dialPod(listener *stream.ListenerConfig, clientAddr *net.UDPAddr) (*net.UDPConn, string) {
+	podIP, hostIP, targetPort := p.balancer.ChoosePodForKey(listener.Namespace, listener.Service, listener.ServicePort, clientAddr.IP.String())
+	if podIP == "" {
+		return nil, ""
+	}
+
+	podAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(podIP, targetPort))
+	if err != nil {
+		log.Println("CoAP: Invalid pod address ::", err)
+		return nil, ""
+	}
+
+	upstreamConn, err := net.DialUDP("udp", nil, podAddr)
+	if err != nil {
+		log.Println("CoAP: Failed to open flow to pod", podIP, "::", err)
+		p.balancer.SetReqFailed(hostIP, listener.Namespace, listener.Service)
+		return nil, ""
+	}
+
+	return upstreamConn, hostIP
+}
+
+// handleClientMessage forwards a client message to the pod, or queues it while the pod of the flow is chosen,
+// beyond maxPendingMessages messages are dropped
+func (p *Proxy) handleClientMessage(listenConn *net.UDPConn, clientAddr *net.UDPAddr, clientFlow *flow, message []byte, listener *stream.ListenerConfig) {
+	clientFlow.mutex.Lock()
+	upstreamConn := clientFlow.upstreamConn
+	if upstreamConn == nil {
+		if len(clientFlow.pending) < maxPendingMessages {
+			clientFlow.pending = append(clientFlow.pending, message)
+		}
+		clientFlow.mutex.Unlock()
+		return
+	}
+	forward := p.trackClientMessage(listenConn, clientAddr, clientFlow, message, listener)
+	clientFlow.mutex.Unlock()
+
+	if forward {
+		if _, err := upstreamConn.Write(message); err != nil {
+			log.Println("CoAP: Failed to forward message to pod ::", err)
+		}
+	}
+}
+
+// trackClientMessage reports whether a client message is forwarded to the pod, the flow must be locked.
+// Confirmable messages are retransmitted by the proxy and retransmissions from the client are answered from
+// the exchange instead of being forwarded again.
+func (p *Proxy) trackClientMessage(listenConn *net.UDPConn, clientAddr *net.UDPAddr, clientFlow *flow, message []byte, listener *stream.ListenerConfig) bool {
+	if getType(message) != typeConfirmable {
+		return true
+	}
+
+	messageID := getMessageID(message)
+	clientFlow.removeExpiredExchanges()
+	if ex, found := clientFlow.exchanges[messageID]; found {
+		// the ACK got lost on the way to the client, otherwise the proxy is still retransmitting itself
+		if ex.response != nil {
+			_, _ = listenConn.WriteToUDP(ex.response, clientAddr)
+		}
+		return false
+	}
+
+	timeout := p.getInitialTimeout()
+	clientFlow.exchanges[messageID] = &exchange{
+		message:  message,
+		sentTime: time.Now(),
+		expires:  time.Now().Add(exchangeLifetime),
+		timer: time.AfterFunc(timeout, func() {
+			p.retransmit(clientFlow, messageID, timeout*2, listener)
+		}),
+	}
+
+	return true
+}
+
+func (p *Proxy) retransmit(clientFlow *flow, messageID uint16, timeout time.Duration, listener *stream.ListenerConfig) {
+	clientFlow.mutex.Lock()
+	ex, found := clientFlow.exchanges[messageID]
+	if !found || ex.response != nil {
+		clientFlow.mutex.Unlock()
+		return
+	}
+
+	if ex.retransmits >= p.maxRetransmit {
+		delete(clientFlow.exchanges, messageID)
+		clientFlow.mutex.Unlock()
+
+		log.Println("CoAP: No ACK from pod for message", messageID, "after", ex.retransmits, "retransmissions")
+		p.balancer.SetReqFailed(clientFlow.hostIP, listener.Namespace, listener.Service)
+		return
+	}
+
+	ex.retransmits++
+	ex.timer = time.AfterFunc(timeout, func() {
+		p.retransmit(clientFlow, messageID, timeout*2, listener)
+	})
+	clientFlow.mutex.Unlock()
+
+	if _, err := clientFlow.upstreamConn.Write(ex.message); err != nil {
+		log.Println("CoAP: Failed to retransmit message to pod ::", err)
+	}
+}
+
+// readFlow relays messages from the pod to the client, ACKs of confirmable messages that were not
+// retransmitted are used as latency samples (Karn's algorithm), RSTs count as failures
+func (p *Proxy) readFlow(udp *udpListener, clientAddr *net.UDPAddr, clientFlow *flow, listener *stream.ListenerConfig) {
+	defer udp.flows.Delete(clientAddr.String())
+	defer clientFlow.close()
+
+	buffer := make([]byte, maxMessageSize)
+	for {
+		_ = clientFlow.upstreamConn.SetReadDeadline(time.Now().Add(p.getIdleTimeout(udp)))
+		n, err := clientFlow.upstreamConn.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if !(errors.As(err, &netErr) && netErr.Timeout()) {
+				log.Println("CoAP: Flow to pod failed ::", err)
+				p.balancer.SetReqFailed(clientFlow.hostIP, listener.Namespace, listener.Service)
+			}
+			return
+		}
+		if !isValidMessage(buffer[:n]) {
+			continue
+		}
+
+		message := make([]byte, n)
+		copy(message, buffer[:n])
+
+		messageType := getType(message)
+		if messageType == typeAcknowledgment || messageType == typeReset {
+			p.handleResponse(clientFlow, message, messageType, listener)
+		}
+
+		if _, err := udp.conn.WriteToUDP(message, clientAddr); err != nil {
+			log.Println("CoAP: Failed to forward message to client ::", err)
+		}
+	}
+}
+
+func (p *Proxy) handleResponse(clientFlow *flow, message []byte, messageType byte, listener *stream.ListenerConfig) {
+	clientFlow.mutex.Lock()
+	ex, found := clientFlow.exchanges[getMessageID(message)]
+	if !found || ex.response != nil {
+		clientFlow.mutex.Unlock()
+		return
+	}
+
+	ex.timer.Stop()
+	ex.response = message
+	retransmitted := ex.retransmits > 0
+	latency := int(time.Since(ex.sentTime).Milliseconds())
+	clientFlow.mutex.Unlock()
+
+	if messageType == typeReset {
+		log.Println("CoAP: Pod rejected message", getMessageID(message))
+		p.balancer.SetReqFailed(clientFlow.hostIP, listener.Namespace, listener.Service)
+		return
+	}
+	if !retransmitted {
+		p.balancer.SetLatency(clientFlow.hostIP, latency, listener.Namespace, listener.Service)
+	}
+}
+
+// getIdleTimeout returns how long a flow is kept without messages from the pod, after the listener was closed
+// only for the ACK timeout
+func (p *Proxy) getIdleTimeout(udp *udpListener) time.Duration {
+	if udp.closed.Load() {
+		return udp.drainTimeout
+	}
+
+	return time.Duration(p.idleTimeoutS) * time.Second
+}
+
+func (p *Proxy) getInitialTimeout() time.Duration {
+	factor := 1 + rand.Float64()*(ackRandomFactor-1)
+	return time.Duration(float64(p.ackTimeoutMs)*factor) * time.Millisecond
+}
+
+// Close stops taking new clients, the flows in progress are given the ACK timeout to finish
+func (l *udpListener) Close() error {
+	l.closed.Store(true)
+	l.flows.Range(func(_, value any) bool {
+		clientFlow := value.(*flow)
+		clientFlow.mutex.Lock()
+		if clientFlow.upstreamConn != nil {
+			_ = clientFlow.upstreamConn.SetReadDeadline(time.Now().Add(l.drainTimeout))
+		}
+		clientFlow.mutex.Unlock()
+		return true
+	})
+
+	return nil
+}
+
+func (f *flow) removeExpiredExchanges() {
+	for messageID, ex := range f.exchanges {
+		if time.Now().After(ex.expires) {
+			ex.timer.Stop()
+			delete(f.exchanges, messageID)
+		}
+	}
+}
+
+func (f *flow) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, ex := range f.exchanges {
+		ex.timer.Stop()
+	}
+	f.upstreamConn.Close()
+}
+
+// isValidMessage checks the 4 byte header, the version must be 1 and the token at most 8 bytes
+func isValidMessage(message []byte) bool {
+	return len(message) >= 4 && message[0]>>6 == 1 && int(message[0]&0x0f) <= 8 && len(message) >= 4+int(message[0]&0x0f)
+}
+
+func getType(message []byte) byte {
+	return (message[0] >> 4) & 0x03
+}
+
+func getMessageID(message []byte) uint16 {
+	return binary.BigEndian.Uint16(message[2:4])
+}
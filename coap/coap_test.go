@@ -0,0 +1,316 @@
+package coap
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/stream"
+)
+
+type fakeBalancer struct {
+	mutex     sync.Mutex
+	latencies int
+	failures  int
+
+	choose func() (string, string, string)
+}
+
+func (b *fakeBalancer) ChoosePodForKey(string, string, string, string) (string, string, string) {
+	if b.choose != nil {
+		return b.choose()
+	}
+	return "", "", ""
+}
+
+func (b *fakeBalancer) SetLatency(string, int, string, string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.latencies++
+}
+
+func (b *fakeBalancer) SetReqFailed(string, string, string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+}
+
+func (b *fakeBalancer) counts() (int, int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.latencies, b.failures
+}
+
+func message(messageType byte, code byte, messageID uint16) []byte {
+	return []byte{0x40 | messageType<<4, code, byte(messageID >> 8), byte(messageID)}
+}
+
+func listenLocal(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// read returns the next datagram on conn, or nil if none arrives within the timeout
+func read(t *testing.T, conn *net.UDPConn, timeout time.Duration) ([]byte, *net.UDPAddr) {
+	buffer := make([]byte, maxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := conn.ReadFromUDP(buffer)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer[:n], addr
+}
+
+func TestConfirmableExchange(t *testing.T) {
+	tests := []struct {
+		name         string
+		ackTimeoutMs int
+		// copies of the CON the pod receives before it answers, 0 if it never answers
+		podAnswersAfter int
+		answerType      byte
+		// retransmissions of the client before and after the answer reached it
+		clientRetransmits    int
+		clientRetransmitsAck int
+		podCopies            int
+		clientAnswers        int
+		latencies            int
+		failures             int
+	}{
+		{
+			name:            "ACK is relayed and measured",
+			ackTimeoutMs:    1000,
+			podAnswersAfter: 1,
+			answerType:      typeAcknowledgment,
+			podCopies:       1,
+			clientAnswers:   1,
+			latencies:       1,
+		},
+		{
+			name:              "client retransmissions are not forwarded while the exchange is pending",
+			ackTimeoutMs:      1000,
+			podAnswersAfter:   1,
+			answerType:        typeAcknowledgment,
+			clientRetransmits: 3,
+			podCopies:         1,
+			clientAnswers:     1,
+			latencies:         1,
+		},
+		{
+			name:                 "client retransmissions after the ACK are answered by the proxy",
+			ackTimeoutMs:         1000,
+			podAnswersAfter:      1,
+			answerType:           typeAcknowledgment,
+			clientRetransmitsAck: 2,
+			podCopies:            1,
+			clientAnswers:        3,
+			latencies:            1,
+		},
+		{
+			name:            "proxy retransmits until the ACK, which is not measured",
+			ackTimeoutMs:    20,
+			podAnswersAfter: 3,
+			answerType:      typeAcknowledgment,
+			podCopies:       3,
+			clientAnswers:   1,
+		},
+		{
+			name:          "no ACK after the maximum retransmissions is a failure",
+			ackTimeoutMs:  20,
+			podCopies:     3,
+			clientAnswers: 0,
+			failures:      1,
+		},
+		{
+			name:                 "RST is relayed, deduplicated and a failure",
+			ackTimeoutMs:         1000,
+			podAnswersAfter:      1,
+			answerType:           typeReset,
+			clientRetransmitsAck: 1,
+			podCopies:            1,
+			clientAnswers:        2,
+			failures:             1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			podConn := listenLocal(t)
+			listenConn := listenLocal(t)
+			clientConn := listenLocal(t)
+			clientAddr := clientConn.LocalAddr().(*net.UDPAddr)
+
+			upstreamConn, err := net.DialUDP("udp", nil, podConn.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fake := &fakeBalancer{}
+			p := &Proxy{balancer: fake, ackTimeoutMs: test.ackTimeoutMs, maxRetransmit: 2, idleTimeoutS: 5}
+			listener := &stream.ListenerConfig{Namespace: "default", Service: "coap"}
+			clientFlow := &flow{mutex: &sync.Mutex{}, upstreamConn: upstreamConn, hostIP: "10.0.0.1", exchanges: make(map[uint16]*exchange)}
+			udp := &udpListener{conn: listenConn, flows: &sync.Map{}}
+			udp.flows.Store(clientAddr.String(), clientFlow)
+
+			done := make(chan struct{})
+			go func() {
+				p.readFlow(udp, clientAddr, clientFlow, listener)
+				close(done)
+			}()
+			t.Cleanup(func() {
+				upstreamConn.Close()
+				<-done
+			})
+
+			request := message(typeConfirmable, 0x01, 0x1234)
+			p.handleClientMessage(listenConn, clientAddr, clientFlow, request, listener)
+			for i := 0; i < test.clientRetransmits; i++ {
+				p.handleClientMessage(listenConn, clientAddr, clientFlow, request, listener)
+			}
+
+			podCopies := 0
+			clientAnswers := 0
+			if test.podAnswersAfter > 0 {
+				var proxyAddr *net.UDPAddr
+				for podCopies < test.podAnswersAfter {
+					received, addr := read(t, podConn, 2*time.Second)
+					if received == nil {
+						t.Fatalf("pod got %d copies, waiting for %d", podCopies, test.podAnswersAfter)
+					}
+					podCopies++
+					proxyAddr = addr
+				}
+
+				answerCode := byte(0x45)
+				if test.answerType == typeReset {
+					answerCode = 0
+				}
+				_, _ = podConn.WriteToUDP(message(test.answerType, answerCode, 0x1234), proxyAddr)
+
+				for i := 0; i <= test.clientRetransmitsAck; i++ {
+					if i > 0 {
+						p.handleClientMessage(listenConn, clientAddr, clientFlow, request, listener)
+					}
+					answer, _ := read(t, clientConn, 2*time.Second)
+					if answer == nil {
+						break
+					}
+					if getType(answer) != test.answerType || getMessageID(answer) != 0x1234 {
+						t.Fatalf("client got %x", answer)
+					}
+					clientAnswers++
+				}
+			}
+
+			// copies still on the way, or retransmissions until the proxy gives up
+			for {
+				received, _ := read(t, podConn, 500*time.Millisecond)
+				if received == nil {
+					break
+				}
+				podCopies++
+			}
+
+			if podCopies != test.podCopies {
+				t.Errorf("pod got %d copies, want %d", podCopies, test.podCopies)
+			}
+			if clientAnswers != test.clientAnswers {
+				t.Errorf("client got %d answers, want %d", clientAnswers, test.clientAnswers)
+			}
+			latencies, failures := fake.counts()
+			if latencies != test.latencies || failures != test.failures {
+				t.Errorf("got %d latencies and %d failures, want %d and %d", latencies, failures, test.latencies, test.failures)
+			}
+		})
+	}
+}
+
+// TestPendingFlow checks that a slow pod choice for one client does not hold up the others and that the messages
+// of the client arriving meanwhile are forwarded in order once the pod is chosen
+func TestPendingFlow(t *testing.T) {
+	podConn := listenLocal(t)
+	podPort := strconv.Itoa(podConn.LocalAddr().(*net.UDPAddr).Port)
+	slowClient := listenLocal(t)
+	fastClient := listenLocal(t)
+
+	choosing := make(chan struct{})
+	release := make(chan struct{})
+	var calls atomic.Int32
+	fake := &fakeBalancer{choose: func() (string, string, string) {
+		if calls.Add(1) == 1 {
+			close(choosing)
+			<-release
+		}
+		return "127.0.0.1", "10.0.0.1", podPort
+	}}
+
+	p := &Proxy{balancer: fake, ackTimeoutMs: 100, maxRetransmit: 0, idleTimeoutS: 5}
+	closer, err := p.Serve(&stream.ListenerConfig{Port: "0", Namespace: "default", Service: "coap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := closer.(*udpListener)
+	proxyAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udp.conn.LocalAddr().(*net.UDPAddr).Port}
+	t.Cleanup(func() {
+		_ = closer.Close()
+		udp.conn.Close()
+		p.Wait()
+	})
+
+	// a confirmable request, its retransmission and a non-confirmable message wait for the slow choice
+	for _, pending := range [][]byte{message(typeConfirmable, 0x01, 1), message(typeConfirmable, 0x01, 1), message(typeNonConfirmable, 0x01, 2)} {
+		_, _ = slowClient.WriteToUDP(pending, proxyAddr)
+	}
+	<-choosing
+
+	_, _ = fastClient.WriteToUDP(message(typeNonConfirmable, 0x01, 3), proxyAddr)
+	if received, _ := read(t, podConn, 2*time.Second); received == nil || getMessageID(received) != 3 {
+		t.Fatalf("pod got %x from the other client while the choice was pending, want message 3", received)
+	}
+
+	close(release)
+	for _, messageID := range []uint16{1, 2} {
+		received, _ := read(t, podConn, 2*time.Second)
+		if received == nil || getMessageID(received) != messageID {
+			t.Fatalf("pod got %x, want pending message %d", received, messageID)
+		}
+	}
+	// the retransmission is answered by the proxy, which does not retransmit itself with a maximum of 0
+	if received, _ := read(t, podConn, 300*time.Millisecond); received != nil {
+		t.Fatalf("pod got unexpected %x", received)
+	}
+}
+
+func TestIsValidMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		valid   bool
+	}{
+		{name: "empty message", message: message(typeConfirmable, 0x01, 1), valid: true},
+		{name: "with token", message: []byte{0x42, 0x01, 0x00, 0x01, 0xaa, 0xbb}, valid: true},
+		{name: "too short", message: []byte{0x40, 0x01, 0x00}},
+		{name: "version 2", message: []byte{0x80, 0x01, 0x00, 0x01}},
+		{name: "token length over 8", message: append([]byte{0x49, 0x01, 0x00, 0x01}, make([]byte, 9)...)},
+		{name: "truncated token", message: []byte{0x44, 0x01, 0x00, 0x01, 0xaa}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if valid := isValidMessage(test.message); valid != test.valid {
+				t.Fatalf("got %v, want %v", valid, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const balancerCheckTimeout = time.Second
+
+// healthzHandler is the liveness check, it only fails if the proxy can't serve and has to be restarted, not
+// when the API server is unavailable, which a restart doesn't fix
+func healthzHandler(rw http.ResponseWriter, req *http.Request) {
+	writeChecks(rw, map[string]error{
+		"serving":  checkServing(),
+		"balancer": checkBalancer(),
+	})
+}
+
+// readyzHandler is the readiness check, it also fails while the proxy is draining, before the API server is
+// reachable, node metrics were fetched and the informers synced
+func readyzHandler(rw http.ResponseWriter, req *http.Request) {
+	checks := edgeClient.Check()
+	checks["serving"] = checkServing()
+	checks["balancer"] = checkBalancer()
+	if draining.Load() {
+		checks["draining"] = errors.New("proxy is shutting down")
+	} else {
+		checks["draining"] = nil
+	}
+
+	writeChecks(rw, checks)
+}
+
+func checkServing() error {
+	if listeningServers.Load() < registeredServers.Load() {
+		return errors.New("not all servers are listening")
+	}
+
+	return nil
+}
+
+func checkBalancer() error {
+	if !edgeBalancer.IsResponsive(balancerCheckTimeout) {
+		return errors.New("balancer is not responding")
+	}
+
+	return nil
+}
+
+// writeChecks writes one line per check, sorted by name, with 503 if a check failed
+func writeChecks(rw http.ResponseWriter, checks map[string]error) {
+	names := make([]string, 0, len(checks))
+	status := http.StatusOK
+	for name, err := range checks {
+		names = append(names, name)
+		if err != nil {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	sort.Strings(names)
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(status)
+	for _, name := range names {
+		if checks[name] != nil {
+			_, _ = fmt.Fprintf(rw, "[-]%s failed: %s\n", name, checks[name])
+		} else {
+			_, _ = fmt.Fprintf(rw, "[+]%s ok\n", name)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
@@ -16,7 +17,13 @@ import (
 	"github.com/robfig/cron/v3"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -26,22 +33,42 @@ import (
 
 const defaultcacheHoldTimeS int = 360
 const defaultNodesMetricsCacheTimeS = 60
+const defaultSiteLabel string = "qedgeproxy.aiotwin.eu/site"
+const defaultAPIContactMaxAgeS int = 300
+
+var routeRuleResource = schema.GroupVersionResource{Group: "qedgeproxy.aiotwin.eu", Version: "v1alpha1", Resource: "qedgeroutes"}
 
 type K3sClient struct {
 	config           *rest.Config
 	clientset        *kubernetes.Clientset
 	metricsClientset *metricsv.Clientset
+	dynamicClient    dynamic.Interface
 	podCache         *sync.Map
 
 	nodesStatus    map[string]*model.NodeMetrics
+	nodesTopology  map[string]*model.NodeTopology
 	nodesCacheTime int
+	siteLabel      string
 
 	serviceMaintainerMap map[string]*model.MaintainerData
 
 	cacheHoldTimeS int
 
-	cacheMutex    *sync.RWMutex
-	cronScheduler *cron.Cron
+	// lastAPIContact is the unix time of the last successful request to the API server
+	lastAPIContact    atomic.Int64
+	apiContactMaxAgeS int
+
+	cacheMutex          *sync.RWMutex
+	nodesScheduler      *cron.Cron
+	maintainerScheduler *cron.Cron
+	watchStopCh         chan struct{}
+	stopOnce            *sync.Once
+
+	secretListers map[string]*secretCache
+	secretMutex   *sync.Mutex
+
+	informersSynced []cache.InformerSynced
+	informerMutex   *sync.Mutex
 }
 
 func NewSK3sClient(configFilePath string) (*K3sClient, error) {
@@ -64,6 +91,12 @@ func NewSK3sClient(configFilePath string) (*K3sClient, error) {
 		return nil, err
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+
 	cacheHoldTimeS, err := strconv.Atoi(os.Getenv("CACHE_HOLD_TIME_S"))
 	if err != nil {
 		cacheHoldTimeS = defaultcacheHoldTimeS
@@ -76,15 +109,35 @@ func NewSK3sClient(configFilePath string) (*K3sClient, error) {
 	}
 	log.Println("NODE_METRICS_CACHE_TIME_S:", nodesMetricsCacheTimeS)
 
+	siteLabel := os.Getenv("EDGE_SITE_LABEL")
+	if siteLabel == "" {
+		siteLabel = defaultSiteLabel
+	}
+	log.Println("EDGE_SITE_LABEL:", siteLabel)
+
+	apiContactMaxAgeS, err := strconv.Atoi(os.Getenv("API_CONTACT_MAX_AGE_S"))
+	if err != nil {
+		apiContactMaxAgeS = defaultAPIContactMaxAgeS
+	}
+	log.Println("API_CONTACT_MAX_AGE_S:", apiContactMaxAgeS)
+
 	client := &K3sClient{
 		config:               config,
 		clientset:            clientset,
 		metricsClientset:     metricsClientset,
+		dynamicClient:        dynamicClient,
 		podCache:             &sync.Map{},
 		serviceMaintainerMap: make(map[string]*model.MaintainerData),
 		nodesCacheTime:       nodesMetricsCacheTimeS,
+		siteLabel:            siteLabel,
 		cacheHoldTimeS:       cacheHoldTimeS,
+		apiContactMaxAgeS:    apiContactMaxAgeS,
 		cacheMutex:           &sync.RWMutex{},
+		watchStopCh:          make(chan struct{}),
+		stopOnce:             &sync.Once{},
+		secretListers:        make(map[string]*secretCache),
+		secretMutex:          &sync.Mutex{},
+		informerMutex:        &sync.Mutex{},
 	}
 	client.startNodeStatusInfoRefresher()
 	client.startPodInfoMaintainer()
@@ -92,24 +145,26 @@ func NewSK3sClient(configFilePath string) (*K3sClient, error) {
 	return client, nil
 }
 
-func (c *K3sClient) GetPodsForService(namespace string, serviceName string) ([]*model.PodInfo, map[string]string, string, error) {
-	if cached, found := c.podCache.Load(serviceName); found {
+func (c *K3sClient) GetPodsForService(namespace string, serviceName string) ([]*model.PodInfo, map[string]string, []*model.ServicePort, error) {
+	serviceKey := model.ServiceKey(namespace, serviceName)
+	if cached, found := c.podCache.Load(serviceKey); found {
 		cachedData := cached.(*model.PodInfoCache)
 
-		c.serviceMaintainerMap[serviceName].LastRequestTime = time.Now()
+		c.serviceMaintainerMap[serviceKey].LastRequestTime = time.Now()
 
 		log.Println("Returning cached data for service", serviceName)
-		return cachedData.Pods, cachedData.Annotations, cachedData.TargetPort, nil
+		return cachedData.Pods, cachedData.Annotations, cachedData.Ports, nil
 	}
 
 	service, err := c.clientset.CoreV1().Services(namespace).Get(context.Background(), serviceName, metav1.GetOptions{})
 	if err != nil {
 		log.Printf("Failed to get service %s: %v\n", serviceName, err)
-		return nil, nil, "", err
+		return nil, nil, nil, err
 	}
+	c.markAPIContact()
 
-	defer c.startListener(namespace, serviceName, labels.Set(service.Spec.Selector).AsSelector())
-	return c.initService(namespace, serviceName, service)
+	defer c.startListener(namespace, serviceKey, labels.Set(service.Spec.Selector).AsSelector())
+	return c.initService(namespace, serviceKey, service)
 }
 
 func (c *K3sClient) GetNodesStatus() (map[string]*model.NodeMetrics, error) {
@@ -125,13 +180,51 @@ func (c *K3sClient) GetNodesStatus() (map[string]*model.NodeMetrics, error) {
 	return nil, fmt.Errorf("Nodes status map is not initialized")
 }
 
+// GetNodesTopology returns the site, zone and region of the nodes keyed by host IP
+func (c *K3sClient) GetNodesTopology() map[string]*model.NodeTopology {
+	c.cacheMutex.RLock()
+	defer c.cacheMutex.RUnlock()
+
+	return c.nodesTopology
+}
+
+// WatchRouteRules watches QEdgeRoute objects in all namespaces, the handler receives the rules of each
+// object keyed by the object, with no rules once the object is deleted
+func (c *K3sClient) WatchRouteRules(handler func(source string, rules []*model.RouteRule)) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.dynamicClient, 0)
+	informer := factory.ForResource(routeRuleResource).Informer()
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			onRouteRuleChange(obj, handler)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			onRouteRuleChange(newObj, handler)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if routeObj, ok := obj.(*unstructured.Unstructured); ok {
+				handler(getRouteRuleSource(routeObj), nil)
+			}
+		},
+	})
+	if err != nil {
+		log.Println("Failed to watch route rules ::", err)
+		return
+	}
+
+	c.runInformer(informer)
+}
+
 func (c *K3sClient) startNodeStatusInfoRefresher() {
 	c.refreshNodesStatusInfo()
 
-	c.cronScheduler = cron.New(cron.WithSeconds())
-	_, _ = c.cronScheduler.AddFunc(fmt.Sprintf("@every %ds", c.nodesCacheTime), c.refreshNodesStatusInfo)
+	c.nodesScheduler = cron.New(cron.WithSeconds())
+	_, _ = c.nodesScheduler.AddFunc(fmt.Sprintf("@every %ds", c.nodesCacheTime), c.refreshNodesStatusInfo)
 
-	c.cronScheduler.Start()
+	c.nodesScheduler.Start()
 }
 
 func (c *K3sClient) refreshNodesStatusInfo() {
@@ -140,6 +233,23 @@ func (c *K3sClient) refreshNodesStatusInfo() {
 		log.Println("Failed to retrieve nodes on node status")
 		return
 	}
+	c.markAPIContact()
+
+	// topology is refreshed even if the metrics are not available
+	topologyMap := make(map[string]*model.NodeTopology)
+	for _, node := range nodes.Items {
+		if hostIP := getHostIp(node); hostIP != "" {
+			topologyMap[hostIP] = &model.NodeTopology{
+				Site:   node.Labels[c.siteLabel],
+				Zone:   node.Labels[corev1.LabelTopologyZone],
+				Region: node.Labels[corev1.LabelTopologyRegion],
+			}
+		}
+	}
+
+	c.cacheMutex.Lock()
+	c.nodesTopology = topologyMap
+	c.cacheMutex.Unlock()
 
 	nodeMetricsList, err := c.metricsClientset.MetricsV1beta1().NodeMetricses().List(context.Background(), metav1.ListOptions{})
 	if err != nil {
@@ -187,62 +297,78 @@ func (c *K3sClient) refreshNodesStatusInfo() {
 }
 
 func (c *K3sClient) startPodInfoMaintainer() {
-	c.cronScheduler = cron.New(cron.WithSeconds())
-	_, _ = c.cronScheduler.AddFunc("@every 60s", c.maintainServiceInfo)
+	c.maintainerScheduler = cron.New(cron.WithSeconds())
+	_, _ = c.maintainerScheduler.AddFunc("@every 60s", c.maintainServiceInfo)
+
+	c.maintainerScheduler.Start()
+}
+
+// Stop stops the cron jobs, waiting for running ones, and the informers of the services and the watches
+func (c *K3sClient) Stop() {
+	c.stopOnce.Do(func() {
+		<-c.nodesScheduler.Stop().Done()
+		<-c.maintainerScheduler.Stop().Done()
 
-	c.cronScheduler.Start()
+		for _, maintenanceData := range c.serviceMaintainerMap {
+			close(maintenanceData.Channel)
+		}
+		c.serviceMaintainerMap = make(map[string]*model.MaintainerData)
+		close(c.watchStopCh)
+
+		log.Println("Stopped k3s client")
+	})
 }
 
 func (c *K3sClient) maintainServiceInfo() {
 	var clearedServices []string
-	for serviceName, maintenanceData := range c.serviceMaintainerMap {
+	for serviceKey, maintenanceData := range c.serviceMaintainerMap {
 		if time.Since(maintenanceData.LastRequestTime).Seconds() > float64(c.cacheHoldTimeS) {
 			close(maintenanceData.Channel)
-			c.podCache.Delete(serviceName)
+			c.podCache.Delete(serviceKey)
 
-			clearedServices = append(clearedServices, serviceName)
+			clearedServices = append(clearedServices, serviceKey)
 		}
 	}
 
-	for _, serviceName := range clearedServices {
-		delete(c.serviceMaintainerMap, serviceName)
+	for _, serviceKey := range clearedServices {
+		delete(c.serviceMaintainerMap, serviceKey)
 	}
 }
 
-func (c *K3sClient) initService(namespace string, serviceName string, service *corev1.Service) ([]*model.PodInfo, map[string]string, string, error) {
+func (c *K3sClient) initService(namespace string, serviceKey string, service *corev1.Service) ([]*model.PodInfo, map[string]string, []*model.ServicePort, error) {
 	podList := make([]*model.PodInfo, 0)
 
-	targetPort := strconv.Itoa(int(service.Spec.Ports[0].TargetPort.IntVal))
+	ports := getServicePorts(service)
 	annotations := service.Annotations
 
 	podSelector := &metav1.LabelSelector{MatchLabels: service.Spec.Selector}
 	pods, err := c.clientset.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: metav1.FormatLabelSelector(podSelector)})
 	if err != nil {
-		log.Printf("Failed to list pods for service %s: %v\n", serviceName, err)
-		return nil, nil, "", err
+		log.Printf("Failed to list pods for service %s: %v\n", serviceKey, err)
+		return nil, nil, nil, err
 	}
 
-	for _, pod := range pods.Items {
-		podList = append(podList, &model.PodInfo{Name: pod.Name, Namespace: pod.Namespace, IP: pod.Status.PodIP, HostIP: pod.Status.HostIP})
+	for i := range pods.Items {
+		podList = append(podList, getPodInfo(&pods.Items[i]))
 	}
 
 	cacheData := &model.PodInfoCache{
 		Pods:        podList,
 		Annotations: annotations,
-		TargetPort:  targetPort,
+		Ports:       ports,
 	}
 
-	c.podCache.Store(serviceName, cacheData)
-	log.Println("Manually updated pods cache for service:", serviceName)
+	c.podCache.Store(serviceKey, cacheData)
+	log.Println("Manually updated pods cache for service:", serviceKey)
 
-	c.serviceMaintainerMap[serviceName] = &model.MaintainerData{
+	c.serviceMaintainerMap[serviceKey] = &model.MaintainerData{
 		LastRequestTime: time.Now(),
 	}
 
-	return podList, annotations, targetPort, nil
+	return podList, annotations, ports, nil
 }
 
-func (c *K3sClient) startListener(namespace string, serviceName string, labelSelector labels.Selector) {
+func (c *K3sClient) startListener(namespace string, serviceKey string, labelSelector labels.Selector) {
 	watchList := cache.NewFilteredListWatchFromClient(
 		c.clientset.CoreV1().RESTClient(),
 		"pods",
@@ -258,28 +384,28 @@ func (c *K3sClient) startListener(namespace string, serviceName string, labelSel
 		time.Second*0,
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				c.onPodAdd(obj, serviceName)
+				c.onPodAdd(obj, serviceKey)
 			},
 			DeleteFunc: func(obj interface{}) {
-				c.onPodDelete(obj, serviceName)
+				c.onPodDelete(obj, serviceKey)
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
-				c.onPodChange(newObj, serviceName)
+				c.onPodChange(newObj, serviceKey)
 			},
 		},
 	)
 
 	stopCh := make(chan struct{})
-	c.serviceMaintainerMap[serviceName].Channel = stopCh
+	c.serviceMaintainerMap[serviceKey].Channel = stopCh
 
 	go controller.Run(stopCh)
 }
 
-func (c *K3sClient) onPodChange(obj interface{}, serviceName string) {
+func (c *K3sClient) onPodChange(obj interface{}, serviceKey string) {
 	pod := obj.(*corev1.Pod)
 
-	podInfo := &model.PodInfo{Name: pod.Name, Namespace: pod.Namespace, IP: pod.Status.PodIP, HostIP: pod.Status.HostIP}
-	podCache, _ := c.podCache.Load(serviceName)
+	podInfo := getPodInfo(pod)
+	podCache, _ := c.podCache.Load(serviceKey)
 
 	podIndex := indexOfPods(podCache.(*model.PodInfoCache).Pods, func(p *model.PodInfo) bool {
 		return p.Name == podInfo.Name
@@ -288,13 +414,13 @@ func (c *K3sClient) onPodChange(obj interface{}, serviceName string) {
 	if podIndex >= 0 {
 		podCache.(*model.PodInfoCache).Pods[podIndex] = podInfo
 
-		c.podCache.Store(serviceName, podCache)
+		c.podCache.Store(serviceKey, podCache)
 	}
 }
 
-func (c *K3sClient) onPodAdd(obj interface{}, serviceName string) {
+func (c *K3sClient) onPodAdd(obj interface{}, serviceKey string) {
 	pod := obj.(*corev1.Pod)
-	podCache, _ := c.podCache.Load(serviceName)
+	podCache, _ := c.podCache.Load(serviceKey)
 
 	podIndex := indexOfPods(podCache.(*model.PodInfoCache).Pods, func(p *model.PodInfo) bool {
 		return p.Name == pod.Name
@@ -304,20 +430,20 @@ func (c *K3sClient) onPodAdd(obj interface{}, serviceName string) {
 		return
 	}
 
-	adjustedPods := append(podCache.(*model.PodInfoCache).Pods, &model.PodInfo{Name: pod.Name, Namespace: pod.Namespace, IP: pod.Status.PodIP, HostIP: pod.Status.HostIP})
+	adjustedPods := append(podCache.(*model.PodInfoCache).Pods, getPodInfo(pod))
 	podCache.(*model.PodInfoCache).Pods = adjustedPods
-	c.podCache.Store(serviceName, podCache)
+	c.podCache.Store(serviceKey, podCache)
 }
 
-func (c *K3sClient) onPodDelete(obj interface{}, serviceName string) {
+func (c *K3sClient) onPodDelete(obj interface{}, serviceKey string) {
 	pod := obj.(*corev1.Pod)
-	podCache, _ := c.podCache.Load(serviceName)
+	podCache, _ := c.podCache.Load(serviceKey)
 
 	filteredPods := filterPods(podCache.(*model.PodInfoCache).Pods, func(p *model.PodInfo) bool {
 		return p.Name != pod.Name
 	})
 	podCache.(*model.PodInfoCache).Pods = filteredPods
-	c.podCache.Store(serviceName, podCache)
+	c.podCache.Store(serviceKey, podCache)
 }
 
 func (c *K3sClient) createNodeStatusMapCopy() map[string]*model.NodeMetrics {
@@ -349,6 +475,67 @@ func indexOfPods(pods []*model.PodInfo, condition func(*model.PodInfo) bool) int
 	return -1
 }
 
+func onRouteRuleChange(obj interface{}, handler func(source string, rules []*model.RouteRule)) {
+	routeObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	rule := &model.RouteRule{}
+	spec, _, err := unstructured.NestedMap(routeObj.Object, "spec")
+	if err == nil {
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(spec, rule)
+	}
+	if err != nil || rule.Service == "" {
+		log.Println("Invalid route rule", getRouteRuleSource(routeObj), "::", err)
+		handler(getRouteRuleSource(routeObj), nil)
+		return
+	}
+
+	rule.Name = routeObj.GetNamespace() + "/" + routeObj.GetName()
+	if rule.Namespace == "" {
+		rule.Namespace = routeObj.GetNamespace()
+	}
+
+	handler(getRouteRuleSource(routeObj), []*model.RouteRule{rule})
+}
+
+func getRouteRuleSource(routeObj *unstructured.Unstructured) string {
+	return "qedgeroute/" + routeObj.GetNamespace() + "/" + routeObj.GetName()
+}
+
+func getPodInfo(pod *corev1.Pod) *model.PodInfo {
+	// named container ports are kept so that services with a named targetPort can be resolved per pod
+	ports := make(map[string]string)
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name != "" {
+				ports[port.Name] = strconv.Itoa(int(port.ContainerPort))
+			}
+		}
+	}
+
+	return &model.PodInfo{Name: pod.Name, Namespace: pod.Namespace, IP: pod.Status.PodIP, HostIP: pod.Status.HostIP, Ports: ports}
+}
+
+func getServicePorts(service *corev1.Service) []*model.ServicePort {
+	ports := make([]*model.ServicePort, 0, len(service.Spec.Ports))
+	for _, port := range service.Spec.Ports {
+		targetPort := port.TargetPort.String()
+		if port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal == 0 {
+			targetPort = strconv.Itoa(int(port.Port))
+		}
+
+		ports = append(ports, &model.ServicePort{
+			Name:       port.Name,
+			Port:       strconv.Itoa(int(port.Port)),
+			TargetPort: targetPort,
+		})
+	}
+
+	return ports
+}
+
 func getHostIp(node corev1.Node) string {
 	for _, val := range node.Status.Addresses {
 		if val.Type == corev1.NodeInternalIP {
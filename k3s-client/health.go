@@ -0,0 +1,81 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// runInformer runs the informer until the client is stopped, it is synced before the client is ready
+func (c *K3sClient) runInformer(informer cache.SharedIndexInformer) {
+	c.addInformerSynced(informer.HasSynced)
+	go informer.Run(c.watchStopCh)
+}
+
+func (c *K3sClient) addInformerSynced(hasSynced cache.InformerSynced) {
+	c.informerMutex.Lock()
+	defer c.informerMutex.Unlock()
+
+	c.informersSynced = append(c.informersSynced, hasSynced)
+}
+
+// newStopCh returns a stop channel that is closed when the client is stopped or cancel is called
+func (c *K3sClient) newStopCh() (<-chan struct{}, func()) {
+	stopCh := make(chan struct{})
+	cancelCh := make(chan struct{})
+	cancelOnce := &sync.Once{}
+
+	go func() {
+		select {
+		case <-c.watchStopCh:
+		case <-cancelCh:
+		}
+		close(stopCh)
+	}()
+
+	return stopCh, func() { cancelOnce.Do(func() { close(cancelCh) }) }
+}
+
+func (c *K3sClient) markAPIContact() {
+	c.lastAPIContact.Store(time.Now().Unix())
+}
+
+// Check returns the result of the checks of the client by name: the API server answered within the last
+// API_CONTACT_MAX_AGE_S, node metrics were fetched at least once and the informers of the watches synced, a nil
+// error means the check passed. The checks only look at the state of the client, so they are cheap enough for
+// every probe.
+func (c *K3sClient) Check() map[string]error {
+	result := make(map[string]error)
+
+	lastAPIContact := c.lastAPIContact.Load()
+	if lastAPIContact == 0 {
+		result["kubernetes"] = errors.New("the API server was not contacted yet")
+	} else if age := time.Since(time.Unix(lastAPIContact, 0)); age > time.Duration(c.apiContactMaxAgeS)*time.Second {
+		result["kubernetes"] = fmt.Errorf("no successful request to the API server for %s", age.Round(time.Second))
+	} else {
+		result["kubernetes"] = nil
+	}
+
+	c.cacheMutex.RLock()
+	if c.nodesStatus == nil {
+		result["node-metrics"] = errors.New("node metrics were not fetched yet")
+	} else {
+		result["node-metrics"] = nil
+	}
+	c.cacheMutex.RUnlock()
+
+	c.informerMutex.Lock()
+	result["informers"] = nil
+	for _, hasSynced := range c.informersSynced {
+		if !hasSynced() {
+			result["informers"] = errors.New("informers are not synced yet")
+			break
+		}
+	}
+	c.informerMutex.Unlock()
+
+	return result
+}
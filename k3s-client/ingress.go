@@ -0,0 +1,369 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const ingressClassAnnotation string = "kubernetes.io/ingress.class"
+
+var httpRouteResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "httproutes"}
+
+// subset of the Gateway API HTTPRoute spec that is translated into route rules
+type httpRouteSpec struct {
+	ParentRefs []httpRouteParentRef `json:"parentRefs"`
+	Hostnames  []string             `json:"hostnames"`
+	Rules      []httpRouteRule      `json:"rules"`
+}
+
+type httpRouteParentRef struct {
+	Group     *string `json:"group"`
+	Kind      *string `json:"kind"`
+	Namespace string  `json:"namespace"`
+	Name      string  `json:"name"`
+}
+
+type httpRouteRule struct {
+	Matches     []httpRouteMatch      `json:"matches"`
+	Filters     []httpRouteFilter     `json:"filters"`
+	BackendRefs []httpRouteBackendRef `json:"backendRefs"`
+}
+
+type httpRouteMatch struct {
+	Path    *httpRouteValueMatch  `json:"path"`
+	Headers []httpRouteValueMatch `json:"headers"`
+}
+
+type httpRouteValueMatch struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type httpRouteFilter struct {
+	Type       string `json:"type"`
+	URLRewrite *struct {
+		Path *struct {
+			Type               string `json:"type"`
+			ReplacePrefixMatch string `json:"replacePrefixMatch"`
+		} `json:"path"`
+	} `json:"urlRewrite"`
+}
+
+type httpRouteBackendRef struct {
+	Group     string `json:"group"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Port      int32  `json:"port"`
+	Weight    *int32 `json:"weight"`
+}
+
+// WatchIngresses watches Ingress objects of the given ingress class in all namespaces and translates their rules,
+// the handler receives the rules of each Ingress keyed by the object, with no rules once the object is deleted
+func (c *K3sClient) WatchIngresses(ingressClass string, handler func(source string, rules []*model.RouteRule)) {
+	factory := informers.NewSharedInformerFactory(c.clientset, 0)
+	informer := factory.Networking().V1().Ingresses().Informer()
+
+	onChange := func(obj interface{}) {
+		ingress, ok := obj.(*networkingv1.Ingress)
+		if !ok {
+			return
+		}
+
+		source := "ingress/" + ingress.Namespace + "/" + ingress.Name
+		if getIngressClass(ingress) != ingressClass {
+			handler(source, nil)
+			return
+		}
+
+		handler(source, getIngressRules(ingress))
+	}
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: onChange,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			onChange(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if ingress, ok := obj.(*networkingv1.Ingress); ok {
+				handler("ingress/"+ingress.Namespace+"/"+ingress.Name, nil)
+			}
+		},
+	})
+	if err != nil {
+		log.Println("Failed to watch ingresses ::", err)
+		return
+	}
+
+	c.runInformer(informer)
+}
+
+// WatchHTTPRoutes watches Gateway API HTTPRoute objects attached to the given gateway in all namespaces and
+// translates their rules, the handler receives the rules of each HTTPRoute keyed by the object
+func (c *K3sClient) WatchHTTPRoutes(gatewayNamespace string, gatewayName string, handler func(source string, rules []*model.RouteRule)) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.dynamicClient, 0)
+	informer := factory.ForResource(httpRouteResource).Informer()
+
+	onChange := func(obj interface{}) {
+		routeObj, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+
+		source := "httproute/" + routeObj.GetNamespace() + "/" + routeObj.GetName()
+		rules, err := getHTTPRouteRules(routeObj, gatewayNamespace, gatewayName)
+		if err != nil {
+			log.Println("Invalid HTTPRoute", source, "::", err)
+		}
+
+		handler(source, rules)
+	}
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: onChange,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			onChange(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if routeObj, ok := obj.(*unstructured.Unstructured); ok {
+				handler("httproute/"+routeObj.GetNamespace()+"/"+routeObj.GetName(), nil)
+			}
+		},
+	})
+	if err != nil {
+		log.Println("Failed to watch HTTPRoutes ::", err)
+		return
+	}
+
+	c.runInformer(informer)
+}
+
+func getIngressClass(ingress *networkingv1.Ingress) string {
+	if ingress.Spec.IngressClassName != nil {
+		return *ingress.Spec.IngressClassName
+	}
+
+	return ingress.Annotations[ingressClassAnnotation]
+}
+
+func getIngressRules(ingress *networkingv1.Ingress) []*model.RouteRule {
+	rules := make([]*model.RouteRule, 0)
+
+	if backend := ingress.Spec.DefaultBackend; backend != nil && backend.Service != nil {
+		rules = append(rules, &model.RouteRule{
+			Name:      fmt.Sprintf("ingress/%s/%s-default", ingress.Namespace, ingress.Name),
+			Namespace: ingress.Namespace,
+			Service:   backend.Service.Name,
+			Port:      getIngressBackendPort(backend.Service.Port),
+		})
+	}
+
+	for ruleIndex, ingressRule := range ingress.Spec.Rules {
+		if ingressRule.HTTP == nil {
+			continue
+		}
+
+		for pathIndex, path := range ingressRule.HTTP.Paths {
+			if path.Backend.Service == nil {
+				log.Println("Ingress", ingress.Namespace+"/"+ingress.Name, "has a non-service backend, skipping path", path.Path)
+				continue
+			}
+
+			// implementation specific paths are matched as prefixes
+			rules = append(rules, &model.RouteRule{
+				Name:       fmt.Sprintf("ingress/%s/%s-%d-%d", ingress.Namespace, ingress.Name, ruleIndex, pathIndex),
+				Host:       ingressRule.Host,
+				PathPrefix: path.Path,
+				ExactPath:  path.PathType != nil && *path.PathType == networkingv1.PathTypeExact,
+				Namespace:  ingress.Namespace,
+				Service:    path.Backend.Service.Name,
+				Port:       getIngressBackendPort(path.Backend.Service.Port),
+			})
+		}
+	}
+
+	return rules
+}
+
+func getIngressBackendPort(port networkingv1.ServiceBackendPort) string {
+	if port.Name != "" {
+		return port.Name
+	}
+	if port.Number != 0 {
+		return strconv.Itoa(int(port.Number))
+	}
+
+	return ""
+}
+
+func getHTTPRouteRules(routeObj *unstructured.Unstructured, gatewayNamespace string, gatewayName string) ([]*model.RouteRule, error) {
+	spec, _, err := unstructured.NestedMap(routeObj.Object, "spec")
+	if err != nil {
+		return nil, err
+	}
+
+	routeSpec := &httpRouteSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(spec, routeSpec); err != nil {
+		return nil, err
+	}
+
+	attached := false
+	for _, parentRef := range routeSpec.ParentRefs {
+		if isGatewayRef(parentRef, routeObj.GetNamespace(), gatewayNamespace, gatewayName) {
+			attached = true
+		}
+	}
+	if !attached {
+		return nil, nil
+	}
+	source := routeObj.GetNamespace() + "/" + routeObj.GetName()
+
+	hostnames := routeSpec.Hostnames
+	if len(hostnames) == 0 {
+		hostnames = []string{""}
+	}
+
+	rules := make([]*model.RouteRule, 0)
+	for ruleIndex, routeRule := range routeSpec.Rules {
+		backends := getHTTPRouteBackends(source, routeRule.BackendRefs)
+		if len(backends) == 0 {
+			continue
+		}
+		// a rule splitting its traffic is left out as a whole, routing all of it to one backend is not what it declares
+		if len(backends) > 1 {
+			log.Println("HTTPRoute", source, "rule", ruleIndex, "splits traffic between backends, which is not supported, skipping it")
+			continue
+		}
+
+		backend := backends[0]
+		namespace := backend.Namespace
+		if namespace == "" {
+			namespace = routeObj.GetNamespace()
+		}
+		port := ""
+		if backend.Port != 0 {
+			port = strconv.Itoa(int(backend.Port))
+		}
+
+		rewritePrefix := ""
+		for _, filter := range routeRule.Filters {
+			if filter.Type == "URLRewrite" && filter.URLRewrite != nil && filter.URLRewrite.Path != nil && filter.URLRewrite.Path.Type == "ReplacePrefixMatch" {
+				rewritePrefix = filter.URLRewrite.Path.ReplacePrefixMatch
+			}
+		}
+
+		matches := routeRule.Matches
+		if len(matches) == 0 {
+			matches = []httpRouteMatch{{}}
+		}
+
+		for matchIndex, match := range matches {
+			pathPrefix, exactPath, ok := getHTTPRoutePath(match.Path)
+			if !ok {
+				log.Println("HTTPRoute", source, "path match type", match.Path.Type, "is not supported, skipping the match")
+				continue
+			}
+
+			headers := make(map[string]string)
+			for _, header := range match.Headers {
+				if header.Type != "" && header.Type != "Exact" {
+					log.Println("HTTPRoute", source, "header match type", header.Type, "is not supported")
+					continue
+				}
+				headers[header.Name] = header.Value
+			}
+
+			for hostIndex, hostname := range hostnames {
+				rules = append(rules, &model.RouteRule{
+					Name:          fmt.Sprintf("httproute/%s/%s-%d-%d-%d", routeObj.GetNamespace(), routeObj.GetName(), ruleIndex, matchIndex, hostIndex),
+					Host:          hostname,
+					PathPrefix:    pathPrefix,
+					ExactPath:     exactPath,
+					Headers:       headers,
+					Namespace:     namespace,
+					Service:       backend.Name,
+					Port:          port,
+					RewritePrefix: rewritePrefix,
+				})
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// isGatewayRef reports whether a parent reference of a route names the gateway, the namespace of the reference
+// defaults to the namespace of the route
+func isGatewayRef(parentRef httpRouteParentRef, routeNamespace string, gatewayNamespace string, gatewayName string) bool {
+	if parentRef.Group != nil && *parentRef.Group != httpRouteResource.Group {
+		return false
+	}
+	if parentRef.Kind != nil && *parentRef.Kind != "Gateway" {
+		return false
+	}
+
+	namespace := parentRef.Namespace
+	if namespace == "" {
+		namespace = routeNamespace
+	}
+
+	return parentRef.Name == gatewayName && namespace == gatewayNamespace
+}
+
+// getHTTPRouteBackends returns the service backends of a rule that receive traffic, backends with a weight of 0
+// and references to other kinds are left out
+func getHTTPRouteBackends(source string, backendRefs []httpRouteBackendRef) []httpRouteBackendRef {
+	backends := make([]httpRouteBackendRef, 0, len(backendRefs))
+	for _, backend := range backendRefs {
+		if (backend.Group != "" && backend.Group != "core") || (backend.Kind != "" && backend.Kind != "Service") {
+			log.Println("HTTPRoute", source, "backend", backend.Name, "of kind", backend.Kind, "is not supported, skipping it")
+			continue
+		}
+		if backend.Weight != nil && *backend.Weight == 0 {
+			continue
+		}
+		backends = append(backends, backend)
+	}
+
+	return backends
+}
+
+// getHTTPRoutePath translates a path match into a path and whether it is exact, regular expressions are not
+// supported. A missing match is a prefix match of /.
+func getHTTPRoutePath(path *httpRouteValueMatch) (string, bool, bool) {
+	if path == nil {
+		return "", false, true
+	}
+
+	value := path.Value
+	if value == "" {
+		value = "/"
+	}
+
+	switch path.Type {
+	case "", "PathPrefix":
+		return value, false, true
+	case "Exact":
+		return value, true, true
+	}
+
+	return "", false, false
+}
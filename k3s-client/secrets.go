@@ -0,0 +1,122 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const secretCacheSyncTimeout = 10 * time.Second
+const secretSyncRetryInterval = 30 * time.Second
+
+// secretCache is the secret cache of a namespace, ready is closed once the first sync finished and err is set
+// if it failed
+type secretCache struct {
+	lister   listersv1.SecretLister
+	ready    chan struct{}
+	err      error
+	failedAt time.Time
+}
+
+// GetSecret returns a secret from a cache that is kept up to date by watching the secrets of its namespace,
+// the watch is started on the first request for a namespace and retried 30 s after it failed to sync
+func (c *K3sClient) GetSecret(namespace string, name string) (*corev1.Secret, error) {
+	c.secretMutex.Lock()
+	secrets, found := c.secretListers[namespace]
+	if !found || (secrets.hasFailed() && time.Since(secrets.failedAt) >= secretSyncRetryInterval) {
+		secrets = &secretCache{ready: make(chan struct{})}
+		c.secretListers[namespace] = secrets
+		go c.syncSecrets(namespace, secrets)
+	}
+	c.secretMutex.Unlock()
+
+	<-secrets.ready
+	if secrets.err != nil {
+		return nil, secrets.err
+	}
+
+	return secrets.lister.Secrets(namespace).Get(name)
+}
+
+// syncSecrets starts watching the secrets of a namespace, a watch that does not sync in time is stopped
+func (c *K3sClient) syncSecrets(namespace string, secrets *secretCache) {
+	stopCh, cancel := c.newStopCh()
+	factory := informers.NewSharedInformerFactoryWithOptions(c.clientset, 0, informers.WithNamespace(namespace))
+	informer := factory.Core().V1().Secrets()
+	lister := informer.Lister()
+	go informer.Informer().Run(stopCh)
+
+	syncStopCh := make(chan struct{})
+	timer := time.AfterFunc(secretCacheSyncTimeout, func() { close(syncStopCh) })
+	synced := cache.WaitForCacheSync(syncStopCh, informer.Informer().HasSynced)
+	timer.Stop()
+
+	if !synced {
+		cancel()
+		log.Println("Secrets of namespace", namespace, "not synced, retrying in", secretSyncRetryInterval)
+		secrets.err = fmt.Errorf("secrets of namespace %s not synced", namespace)
+		secrets.failedAt = time.Now()
+		close(secrets.ready)
+		return
+	}
+
+	c.addInformerSynced(informer.Informer().HasSynced)
+	secrets.lister = lister
+	close(secrets.ready)
+	log.Println("Watching secrets of namespace", namespace)
+}
+
+func (s *secretCache) hasFailed() bool {
+	select {
+	case <-s.ready:
+		return s.err != nil
+	default:
+		return false
+	}
+}
+
+// WatchSecrets watches the secrets of a namespace matching the label and field selectors, the handler receives
+// the data of each secret keyed by namespace/name, with no data once the secret is deleted
+func (c *K3sClient) WatchSecrets(namespace string, labelSelector string, fieldSelector string, handler func(source string, data map[string][]byte)) {
+	factory := informers.NewSharedInformerFactoryWithOptions(c.clientset, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labelSelector
+			options.FieldSelector = fieldSelector
+		}),
+	)
+	informer := factory.Core().V1().Secrets().Informer()
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if secret, ok := obj.(*corev1.Secret); ok {
+				handler(secret.Namespace+"/"+secret.Name, secret.Data)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if secret, ok := newObj.(*corev1.Secret); ok {
+				handler(secret.Namespace+"/"+secret.Name, secret.Data)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if secret, ok := obj.(*corev1.Secret); ok {
+				handler(secret.Namespace+"/"+secret.Name, nil)
+			}
+		},
+	})
+	if err != nil {
+		log.Println("Failed to watch secrets ::", err)
+		return
+	}
+
+	c.runInformer(informer)
+}
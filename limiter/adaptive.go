@@ -0,0 +1,111 @@
+package limiter
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	AlgorithmAIMD     = "aimd"
+	AlgorithmGradient = "gradient"
+)
+
+// latencies up to tolerance times the baseline do not count as overload
+const adaptiveTolerance float64 = 2
+const aimdBackoff float64 = 0.9
+const gradientSmoothing float64 = 0.2
+const minAdaptiveLimit float64 = 1
+
+// AdaptiveLimiter adjusts the concurrency limit of each key from the latencies of its requests relative to
+// a no-load baseline latency, so the limit follows the capacity of the pod
+type AdaptiveLimiter struct {
+	mutex        *sync.Mutex
+	initialLimit int
+	maxLimit     int
+	limits       map[string]float64
+}
+
+func NewAdaptiveLimiter(initialLimit int, maxLimit int) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		mutex:        &sync.Mutex{},
+		initialLimit: initialLimit,
+		maxLimit:     maxLimit,
+		limits:       make(map[string]float64),
+	}
+}
+
+// Limit returns the current limit of key, capped by maxLimit if it is greater than 0
+func (a *AdaptiveLimiter) Limit(key string, maxLimit int) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return int(math.Min(a.getLimit(key), a.getMaxLimit(maxLimit)))
+}
+
+// Update adjusts the limit of key with the latency of a finished request in milliseconds, baseline is the
+// no-load latency and inFlight the number of requests that were in flight, dropped requests failed
+func (a *AdaptiveLimiter) Update(key string, algorithm string, latency int, baseline int, inFlight int, dropped bool, maxLimit int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	limit := a.getLimit(key)
+	overloaded := dropped || (baseline > 0 && float64(latency) > adaptiveTolerance*float64(baseline))
+	// the limit only grows when it is used, otherwise an idle pod would get an unbounded limit
+	utilized := float64(inFlight)*2 >= limit
+
+	switch algorithm {
+	case AlgorithmAIMD:
+		if overloaded {
+			limit *= aimdBackoff
+		} else if utilized {
+			limit++
+		}
+	case AlgorithmGradient:
+		if dropped {
+			limit *= aimdBackoff
+			break
+		}
+		if baseline <= 0 || latency <= 0 {
+			break
+		}
+
+		gradient := math.Max(0.5, math.Min(1, adaptiveTolerance*float64(baseline)/float64(latency)))
+		newLimit := limit * gradient
+		if utilized {
+			// a queue of the square root of the limit lets the limit grow while latency is near the baseline
+			newLimit += math.Sqrt(limit)
+		}
+		limit = (1-gradientSmoothing)*limit + gradientSmoothing*newLimit
+	}
+
+	a.limits[key] = math.Max(minAdaptiveLimit, math.Min(limit, a.getMaxLimit(maxLimit)))
+}
+
+// Limits returns the current limits by key
+func (a *AdaptiveLimiter) Limits() map[string]int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	result := make(map[string]int, len(a.limits))
+	for key, limit := range a.limits {
+		result[key] = int(limit)
+	}
+
+	return result
+}
+
+func (a *AdaptiveLimiter) getLimit(key string) float64 {
+	if limit, found := a.limits[key]; found {
+		return limit
+	}
+
+	return float64(a.initialLimit)
+}
+
+func (a *AdaptiveLimiter) getMaxLimit(maxLimit int) float64 {
+	if maxLimit > 0 {
+		return float64(maxLimit)
+	}
+
+	return float64(a.maxLimit)
+}
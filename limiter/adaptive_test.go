@@ -0,0 +1,84 @@
+package limiter
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAdaptiveLimiterUpdate(t *testing.T) {
+	tests := []struct {
+		name         string
+		algorithm    string
+		initialLimit int
+		maxLimit     int
+		latency      int
+		baseline     int
+		inFlight     int
+		dropped      bool
+		want         float64
+	}{
+		{name: "aimd grows while used", algorithm: AlgorithmAIMD, latency: 10, baseline: 10, inFlight: 10, want: 21},
+		{name: "aimd does not grow unused", algorithm: AlgorithmAIMD, latency: 10, baseline: 10, inFlight: 5, want: 20},
+		{name: "aimd tolerates twice the baseline", algorithm: AlgorithmAIMD, latency: 20, baseline: 10, inFlight: 10, want: 21},
+		{name: "aimd shrinks above twice the baseline", algorithm: AlgorithmAIMD, latency: 21, baseline: 10, inFlight: 10, want: 18},
+		{name: "aimd shrinks on drops", algorithm: AlgorithmAIMD, latency: 5, baseline: 10, inFlight: 10, dropped: true, want: 18},
+		{name: "aimd grows without a baseline", algorithm: AlgorithmAIMD, latency: 500, inFlight: 10, want: 21},
+		{name: "aimd is capped", algorithm: AlgorithmAIMD, maxLimit: 20, latency: 10, baseline: 10, inFlight: 10, want: 20},
+		{name: "aimd keeps a limit of one", algorithm: AlgorithmAIMD, initialLimit: 1, latency: 5, baseline: 10, dropped: true, want: 1},
+		{name: "gradient grows at the baseline while used", algorithm: AlgorithmGradient, latency: 10, baseline: 10, inFlight: 10, want: 20 + 0.2*math.Sqrt(20)},
+		{name: "gradient holds at the baseline unused", algorithm: AlgorithmGradient, latency: 10, baseline: 10, inFlight: 5, want: 20},
+		{name: "gradient shrinks above twice the baseline", algorithm: AlgorithmGradient, latency: 30, baseline: 10, inFlight: 5, want: 0.8*20 + 0.2*20*2/3.0},
+		{name: "gradient scales by at most a half", algorithm: AlgorithmGradient, latency: 100, baseline: 10, inFlight: 5, want: 0.8*20 + 0.2*10},
+		{name: "gradient shrinks under load while used", algorithm: AlgorithmGradient, latency: 40, baseline: 10, inFlight: 10, want: 0.8*20 + 0.2*(10+math.Sqrt(20))},
+		{name: "gradient shrinks on drops", algorithm: AlgorithmGradient, latency: 5, baseline: 10, inFlight: 10, dropped: true, want: 18},
+		{name: "gradient holds without a baseline", algorithm: AlgorithmGradient, latency: 500, inFlight: 10, want: 20},
+		{name: "unknown algorithm holds", algorithm: "none", latency: 500, baseline: 10, inFlight: 10, want: 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			initialLimit := test.initialLimit
+			if initialLimit == 0 {
+				initialLimit = 20
+			}
+			a := NewAdaptiveLimiter(initialLimit, 1000)
+
+			a.Update("default/svc/10.42.0.2", test.algorithm, test.latency, test.baseline, test.inFlight, test.dropped, test.maxLimit)
+			if limit := a.limits["default/svc/10.42.0.2"]; math.Abs(limit-test.want) > 1e-9 {
+				t.Fatalf("got limit %f, want %f", limit, test.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimiterConverges(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		latency   int
+		// the limit after the updates is within [minLimit, maxLimit]
+		minLimit int
+		maxLimit int
+	}{
+		{name: "aimd grows to the maximum at the baseline", algorithm: AlgorithmAIMD, latency: 10, minLimit: 100, maxLimit: 100},
+		{name: "aimd shrinks to one under load", algorithm: AlgorithmAIMD, latency: 50, minLimit: 1, maxLimit: 1},
+		{name: "gradient grows to the maximum at the baseline", algorithm: AlgorithmGradient, latency: 10, minLimit: 100, maxLimit: 100},
+		// the limit settles where halving it and adding its square root keeps it, at 4
+		{name: "gradient shrinks under load", algorithm: AlgorithmGradient, latency: 50, minLimit: 3, maxLimit: 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewAdaptiveLimiter(20, 1000)
+			for i := 0; i < 500; i++ {
+				// the pod is kept busy, every request finds the limit in flight
+				limit := a.Limit("key", 100)
+				a.Update("key", test.algorithm, test.latency, 10, limit, false, 100)
+			}
+
+			if limit := a.Limit("key", 100); limit < test.minLimit || limit > test.maxLimit {
+				t.Fatalf("got limit %d, want between %d and %d", limit, test.minLimit, test.maxLimit)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("limiter: queue is full")
+var ErrQueueTimeout = errors.New("limiter: timed out waiting in queue")
+
+// Limiter limits the number of concurrent holders of a key, requests over the limit wait in a bounded FIFO queue
+type Limiter struct {
+	mutex      *sync.Mutex
+	semaphores map[string]*semaphore
+}
+
+type semaphore struct {
+	limit   int
+	active  int
+	waiters []chan struct{}
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		mutex:      &sync.Mutex{},
+		semaphores: make(map[string]*semaphore),
+	}
+}
+
+// Acquire takes a slot of key when fewer than limit slots are taken, otherwise it waits in the queue of key for at
+// most timeout. The returned function releases the slot, the duration is the time spent in the queue.
+// A limit of 0 or less does not limit the key.
+func (l *Limiter) Acquire(ctx context.Context, key string, limit int, queueSize int, timeout time.Duration) (func(), time.Duration, error) {
+	if limit <= 0 {
+		return func() {}, 0, nil
+	}
+
+	l.mutex.Lock()
+	sem := l.semaphores[key]
+	if sem == nil {
+		sem = &semaphore{}
+		l.semaphores[key] = sem
+	}
+	// the limit follows the configuration, a lower limit is reached as slots are released
+	sem.limit = limit
+
+	if sem.active < sem.limit && len(sem.waiters) == 0 {
+		sem.active++
+		l.mutex.Unlock()
+		return l.releaseFunc(key, sem), 0, nil
+	}
+
+	if len(sem.waiters) >= queueSize {
+		l.mutex.Unlock()
+		return nil, 0, ErrQueueFull
+	}
+
+	start := time.Now()
+	ready := make(chan struct{})
+	sem.waiters = append(sem.waiters, ready)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+		return l.releaseFunc(key, sem), time.Since(start), nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i, waiter := range sem.waiters {
+		if waiter == ready {
+			sem.waiters = append(sem.waiters[:i], sem.waiters[i+1:]...)
+			return nil, time.Since(start), err
+		}
+	}
+
+	// the slot was handed over while giving up, it is taken anyway
+	return l.releaseFunc(key, sem), time.Since(start), nil
+}
+
+// IsSaturated reports whether a request for key would have to wait, because limit slots are taken or
+// requests are already waiting
+func (l *Limiter) IsSaturated(key string, limit int) bool {
+	if limit <= 0 {
+		return false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	sem := l.semaphores[key]
+	return sem != nil && (sem.active >= limit || len(sem.waiters) > 0)
+}
+
+// QueueDepth returns the number of waiting requests by key, keys without waiting requests are left out
+func (l *Limiter) QueueDepth() map[string]int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	result := make(map[string]int)
+	for key, sem := range l.semaphores {
+		if len(sem.waiters) > 0 {
+			result[key] = len(sem.waiters)
+		}
+	}
+
+	return result
+}
+
+// Active returns the number of taken slots by key, keys without taken slots are left out
+func (l *Limiter) Active() map[string]int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	result := make(map[string]int)
+	for key, sem := range l.semaphores {
+		if sem.active > 0 {
+			result[key] = sem.active
+		}
+	}
+
+	return result
+}
+
+func (l *Limiter) releaseFunc(key string, sem *semaphore) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.release(key, sem)
+		})
+	}
+}
+
+// release hands the slot to the waiters in order, idle keys are removed
+func (l *Limiter) release(key string, sem *semaphore) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	sem.active--
+	for sem.active < sem.limit && len(sem.waiters) > 0 {
+		ready := sem.waiters[0]
+		sem.waiters = sem.waiters[1:]
+		sem.active++
+		close(ready)
+	}
+
+	if sem.active == 0 && len(sem.waiters) == 0 && l.semaphores[key] == sem {
+		delete(l.semaphores, key)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/limiter"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+)
+
+const defaultQueueTimeoutMs int = 1000
+const defaultAdaptiveInitialLimit int = 20
+const defaultAdaptiveMaxLimit int = 1000
+
+var edgeLimiter *limiter.Limiter
+var edgeAdaptiveLimiter *limiter.AdaptiveLimiter
+
+// acquireServiceSlot takes a slot of the maxConcurrency limit of the service, see acquireSlot
+func acquireServiceSlot(rw http.ResponseWriter, req *http.Request, namespace string, service string) (func(), time.Duration, bool) {
+	limit, err := strconv.Atoi(edgeBalancer.GetServiceAnnotation(namespace, service, "maxConcurrency"))
+	if err != nil {
+		limit = 0
+	}
+
+	return acquireSlot(rw, req, namespace, service, model.ServiceKey(namespace, service), limit)
+}
+
+// acquirePodSlot takes a slot of a pod of the service, limited by getPodLimit, see acquireSlot
+func acquirePodSlot(rw http.ResponseWriter, req *http.Request, namespace string, service string, podIP string) (func(), time.Duration, bool) {
+	return acquireSlot(rw, req, namespace, service, getPodKey(namespace, service, podIP), getPodLimit(namespace, service, podIP))
+}
+
+// newPodAvailability returns the filter of the pods of the service with a free slot, so that the balancer
+// only chooses a pod at its limit when all pods are
+func newPodAvailability(namespace string, service string) func(podIP string) bool {
+	return func(podIP string) bool {
+		return !edgeLimiter.IsSaturated(getPodKey(namespace, service, podIP), getPodLimit(namespace, service, podIP))
+	}
+}
+
+// getPodLimit returns the concurrency limit of a pod of the service, maxPodConcurrency or with the
+// adaptiveConcurrency annotation the adaptive limit of the pod, which maxPodConcurrency then caps
+func getPodLimit(namespace string, service string, podIP string) int {
+	limit, err := strconv.Atoi(edgeBalancer.GetServiceAnnotation(namespace, service, "maxPodConcurrency"))
+	if err != nil {
+		limit = 0
+	}
+
+	if isAdaptiveConcurrency(namespace, service) {
+		limit = edgeAdaptiveLimiter.Limit(getPodKey(namespace, service, podIP), limit)
+	}
+
+	return limit
+}
+
+// observePodRequest adjusts the adaptive limit of the pod with a finished request, against the baseline of the
+// pod before the request, whose latency then counts towards the baseline if it succeeded
+func observePodRequest(namespace string, service string, podIP string, latency int, failed bool) {
+	if !isAdaptiveConcurrency(namespace, service) {
+		return
+	}
+
+	maxLimit, err := strconv.Atoi(edgeBalancer.GetServiceAnnotation(namespace, service, "maxPodConcurrency"))
+	if err != nil {
+		maxLimit = 0
+	}
+
+	baseline, _ := edgeBalancer.GetBaselineLatency(namespace, service, podIP)
+	algorithm := edgeBalancer.GetServiceAnnotation(namespace, service, "adaptiveConcurrency")
+	edgeAdaptiveLimiter.Update(getPodKey(namespace, service, podIP), algorithm, latency, baseline, int(edgeBalancer.GetInFlight(podIP)), failed, maxLimit)
+	if !failed {
+		edgeBalancer.SetPodLatency(namespace, service, podIP, latency)
+	}
+}
+
+func isAdaptiveConcurrency(namespace string, service string) bool {
+	algorithm := edgeBalancer.GetServiceAnnotation(namespace, service, "adaptiveConcurrency")
+	return algorithm == limiter.AlgorithmAIMD || algorithm == limiter.AlgorithmGradient
+}
+
+func getPodKey(namespace string, service string, podIP string) string {
+	return model.ServiceKey(namespace, service) + "/" + podIP
+}
+
+// acquireSlot waits for one of limit slots of key, in a queue of queueSize requests for at most queueTimeoutMs
+// (service annotations). If no slot is free in time 503 is written with Retry-After.
+func acquireSlot(rw http.ResponseWriter, req *http.Request, namespace string, service string, key string, limit int) (func(), time.Duration, bool) {
+	queueSize, err := strconv.Atoi(edgeBalancer.GetServiceAnnotation(namespace, service, "queueSize"))
+	if err != nil {
+		queueSize = 0
+	}
+
+	queueTimeoutMs, err := strconv.Atoi(edgeBalancer.GetServiceAnnotation(namespace, service, "queueTimeoutMs"))
+	if err != nil {
+		queueTimeoutMs = defaultQueueTimeoutMs
+	}
+
+	release, wait, err := edgeLimiter.Acquire(req.Context(), key, limit, queueSize, time.Duration(queueTimeoutMs)*time.Millisecond)
+	if err != nil {
+		log.Println("Concurrency limit", limit, "of", key, "exceeded ::", err)
+		if errors.Is(err, limiter.ErrQueueFull) || errors.Is(err, limiter.ErrQueueTimeout) {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Max(math.Ceil(float64(queueTimeoutMs)/1000), 1))))
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		return nil, wait, false
+	}
+
+	return release, wait, true
+}
+
+// newAdaptiveLimiter creates the adaptive limiter with the ADAPTIVE_INITIAL_LIMIT and ADAPTIVE_MAX_LIMIT limits
+func newAdaptiveLimiter() *limiter.AdaptiveLimiter {
+	initialLimit, err := strconv.Atoi(os.Getenv("ADAPTIVE_INITIAL_LIMIT"))
+	if err != nil || initialLimit < 1 {
+		initialLimit = defaultAdaptiveInitialLimit
+	}
+	log.Println("ADAPTIVE_INITIAL_LIMIT:", initialLimit)
+
+	maxLimit, err := strconv.Atoi(os.Getenv("ADAPTIVE_MAX_LIMIT"))
+	if err != nil || maxLimit < 1 {
+		maxLimit = defaultAdaptiveMaxLimit
+	}
+	log.Println("ADAPTIVE_MAX_LIMIT:", maxLimit)
+
+	return limiter.NewAdaptiveLimiter(initialLimit, maxLimit)
+}
@@ -1,35 +1,54 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/balancer"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/certs"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/coap"
 	client "gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/k3s-client"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/limiter"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/mqtt"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/ratelimit"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/router"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/stream"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	corev1 "k8s.io/api/core/v1"
 )
 
+const defaultTLSSecretSelector string = "qedgeproxy.aiotwin.eu/tls=true"
+const caBundleKey string = "ca.crt"
+
 var edgeBalancer *balancer.Balancer
+var edgeClient *client.K3sClient
+var edgeRouter *router.Router
 
 var ownIP string
-var namespace string
+var defaultNamespace string
+var allowedNamespaces map[string]bool
+var portPathPrefix string
 
-func getOriginServer(service string) (*url.URL, string) {
-	selectedIP, hostIP, targetPort := edgeBalancer.ChoosePod(namespace, service)
+func getOriginServer(namespace string, service string, portName string, affinityKey string, scheme string) (*url.URL, string) {
+	selectedIP, hostIP, targetPort := edgeBalancer.ChoosePodWithFilter(namespace, service, portName, affinityKey, newPodAvailability(namespace, service))
 	if selectedIP == "" {
 		return nil, ""
 	}
 
 	log.Println("Selected pod IP ::", selectedIP+":"+targetPort)
 
-	originServerURL, err := url.Parse("http://" + selectedIP + ":" + targetPort + "/")
+	originServerURL, err := url.Parse(scheme + "://" + selectedIP + ":" + targetPort + "/")
 	if err != nil {
 		log.Println("Invalid origin server URL")
 		return nil, ""
@@ -38,104 +57,430 @@ func getOriginServer(service string) (*url.URL, string) {
 	return originServerURL, hostIP
 }
 
-func forwardRequest(req *http.Request, originServerURL *url.URL, service string, hostIP string) (*http.Response, error) {
+func forwardRequest(req *http.Request, originServerURL *url.URL, upstreamClient *http.Client) (*http.Response, error) {
 	// set req Host, URL and Request URI to forward a request to the origin server
 	req.Host = originServerURL.Host
 	req.URL.Host = originServerURL.Host
 	req.URL.Scheme = originServerURL.Scheme
 	req.RequestURI = ""
 
-	return http.DefaultClient.Do(req)
+	return upstreamClient.Do(req)
 }
 
-func reverseProxyHandler(rw http.ResponseWriter, req *http.Request) {
-	log.Printf("\n\n[reverse proxy server] received request at: %s\n", time.Now())
+// getServiceTarget resolves the namespace, service and service port of a request, routing rules take precedence
+// over the service-name-in-Host convention
+func getServiceTarget(req *http.Request, listenerPort string) (string, string, string) {
+	if rule := edgeRouter.Match(req); rule != nil {
+		namespace := rule.Namespace
+		if namespace == "" {
+			namespace = defaultNamespace
+		}
+		if !allowedNamespaces[namespace] {
+			log.Println("Route", rule.Name, "targets a namespace that is not allowed ::", namespace)
+			return "", "", ""
+		}
 
-	service := strings.Split(req.Host, ".")[0]
-	originServerURL, hostIP := getOriginServer(service)
+		portName := rule.Port
+		if portName == "" {
+			portName = listenerPort
+		}
 
-	if originServerURL == nil {
+		log.Println("Request matched route", rule.Name)
+		router.RewritePath(req, rule)
+		return namespace, rule.Service, portName
+	}
+
+	namespace, service, hostPort := parseHost(req.Host)
+	return namespace, service, getServicePort(req, namespace, service, hostPort, listenerPort)
+}
+
+// parseHost splits a Host of the form service[.port-name][.namespace].… into the namespace, the service and
+// the port name. A label is only treated as a port if it names a port of the service and as a namespace if that
+// namespace is allowed, other labels are part of the domain.
+func parseHost(host string) (string, string, string) {
+	hostLabels := strings.Split(getHostname(host), ".")
+	service := hostLabels[0]
+	namespace := defaultNamespace
+	portName := ""
+
+	labels := hostLabels[1:]
+	if len(labels) > 0 && !allowedNamespaces[labels[0]] {
+		portNamespace := defaultNamespace
+		if len(labels) > 1 && allowedNamespaces[labels[1]] {
+			portNamespace = labels[1]
+		}
+		if edgeBalancer.IsServicePort(portNamespace, service, labels[0]) {
+			portName = labels[0]
+			labels = labels[1:]
+		}
+	}
+	if len(labels) > 0 && allowedNamespaces[labels[0]] {
+		namespace = labels[0]
+	}
+
+	return namespace, service, portName
+}
+
+// getServicePort selects the service port for a request, the port bound to the listener takes
+// precedence over a path prefix (e.g. /_port/metrics/...), which takes precedence over the Host header (svc.port-name.)
+func getServicePort(req *http.Request, namespace string, service string, hostPort string, listenerPort string) string {
+	if listenerPort != "" {
+		return listenerPort
+	}
+
+	if portPathPrefix != "" && strings.HasPrefix(req.URL.Path, portPathPrefix) {
+		portName, path, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, portPathPrefix), "/")
+		req.URL.Path = "/" + path
+		req.URL.RawPath = ""
+		return portName
+	}
+
+	return hostPort
+}
+
+func getHostname(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+
+	return host
+}
+
+func newReverseProxyHandler(listenerPort string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		reverseProxyHandler(rw, req, listenerPort)
+	}
+}
+
+func reverseProxyHandler(rw http.ResponseWriter, req *http.Request, listenerPort string) {
+	log.Printf("\n\n[reverse proxy server] received request at: %s\n", time.Now())
+
+	namespace, service, portName := getServiceTarget(req, listenerPort)
+	if service == "" {
 		rw.WriteHeader(404)
 		_, _ = fmt.Fprint(rw, "No server for Host\n")
 		return
 	}
-	// get the response from the origin server
-	start := time.Now()
-	originServerResponse, err := forwardRequest(req, originServerURL, service, hostIP)
+
+	protocol := getUpstreamProtocol(req, namespace, service)
+	upstreamTLS := isUpstreamTLS(namespace, service, protocol)
+	upstreamClient, err := getUpstreamClient(namespace, service, protocol, upstreamTLS)
 	if err != nil {
-		edgeBalancer.SetReqFailed(hostIP, service)
-		rw.WriteHeader(http.StatusInternalServerError)
-		_, _ = fmt.Fprint(rw, err)
+		log.Println("Failed to configure upstream TLS for service", service, "::", err)
+		rw.WriteHeader(http.StatusBadGateway)
 		return
 	}
-	edgeBalancer.SetLatency(hostIP, int(time.Since(start).Milliseconds()), service)
 
-	// return response to the client
-	rw.WriteHeader(http.StatusOK)
-	io.Copy(rw, originServerResponse.Body)
-}
+	if !checkRateLimits(rw, req, namespace, service) {
+		return
+	}
 
-func echoHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		fmt.Fprintf(w, "Method not allowed")
+	releaseService, serviceWait, ok := acquireServiceSlot(rw, req, namespace, service)
+	if !ok {
 		return
 	}
+	defer releaseService()
 
-	// Get the query parameters from the request
-	queryParams := r.URL.Query()
+	affinityKey := getAffinityKey(rw, req, namespace, service)
+	originServerURL, hostIP := getOriginServer(namespace, service, portName, affinityKey, getUpstreamScheme(upstreamTLS))
+	if originServerURL == nil {
+		rw.WriteHeader(404)
+		_, _ = fmt.Fprint(rw, "No server for Host\n")
+		return
+	}
 
-	// Set the Content-Type header to match the request
-	contentType := r.Header.Get("Content-Type")
-	w.Header().Set("Content-Type", contentType)
+	releasePod, podWait, ok := acquirePodSlot(rw, req, namespace, service, originServerURL.Hostname())
+	if !ok {
+		edgeBalancer.CancelSelection(namespace, service, originServerURL.Hostname(), hostIP, affinityKey)
+		return
+	}
+	defer releasePod()
+	edgeBalancer.SetQueueWait(namespace, service, int((serviceWait + podWait).Milliseconds()))
 
-	// Create a response body by encoding the query parameters as JSON
-	response := make(map[string]interface{})
-	for key, values := range queryParams {
-		if len(values) > 0 {
-			response[key] = values[0]
-		}
+	// count the request towards the pod until the response, or the upgraded connection, is finished
+	edgeBalancer.AcquirePod(originServerURL.Hostname())
+	defer edgeBalancer.ReleasePod(originServerURL.Hostname())
+
+	if isUpgradeRequest(req) {
+		proxyUpgrade(rw, req, originServerURL, upstreamClient, namespace, service, hostIP)
+		return
 	}
 
-	// Encode the response as JSON
-	responseJSON, err := json.Marshal(response)
+	// get the response from the origin server
+	start := time.Now()
+	originServerResponse, err := forwardRequest(req, originServerURL, upstreamClient)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error encoding response: %v", err)
+		// TLS handshake errors, e.g. a pod certificate that does not verify, are failures of the pod as well
+		observePodRequest(namespace, service, originServerURL.Hostname(), int(time.Since(start).Milliseconds()), true)
+		edgeBalancer.SetReqFailed(hostIP, namespace, service)
+		rw.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprint(rw, err)
 		return
 	}
+	defer originServerResponse.Body.Close()
+	latency := int(time.Since(start).Milliseconds())
+
+	// return response to the client
+	writeResponse(rw, originServerResponse)
 
-	// Write the response body back as the response
-	w.WriteHeader(http.StatusOK)
-	w.Write(responseJSON)
+	// a gRPC call only succeeded if its status, known once the response is complete, is not a failure
+	if isGrpcRequest(req) && grpcFailureCodes[getGrpcStatus(originServerResponse)] {
+		log.Println("gRPC call failed with status", getGrpcStatus(originServerResponse))
+		observePodRequest(namespace, service, originServerURL.Hostname(), latency, true)
+		edgeBalancer.SetReqFailed(hostIP, namespace, service)
+		return
+	}
+	observePodRequest(namespace, service, originServerURL.Hostname(), latency, false)
+	edgeBalancer.SetLatency(hostIP, latency, namespace, service)
 }
 
 func main() {
 	port := flag.String("p", "9090", "Port of reverse proxy")
+	tlsPort := flag.String("tls-port", "9443", "Port of reverse proxy with TLS")
+	adminPort := flag.String("admin-port", "9100", "Port of the admin server with metrics")
+	probePort := flag.String("probe-port", "9190", "Port of the probe server answering latency probes")
 	flag.Parse()
 
 	ownIP = os.Getenv("NODE_IP")
-	namespace = os.Getenv("NAMESPACE")
+	defaultNamespace = os.Getenv("NAMESPACE")
+
+	// path prefix selecting a service port, e.g. PORT_PATH_PREFIX="/_port/", disabled when empty
+	portPathPrefix = os.Getenv("PORT_PATH_PREFIX")
+	log.Println("PORT_PATH_PREFIX:", portPathPrefix)
 
-	if ownIP == "" || namespace == "" {
+	if ownIP == "" || defaultNamespace == "" {
 		log.Fatal("ERROR :: Own IP or namespace not detected!")
 		return
 	}
 
+	// services in other namespaces are reachable as service.namespace.… if the namespace is allowed
+	allowedNamespaces = map[string]bool{defaultNamespace: true}
+	for _, allowedNamespace := range strings.Split(os.Getenv("ALLOWED_NAMESPACES"), ",") {
+		if allowedNamespace = strings.TrimSpace(allowedNamespace); allowedNamespace != "" {
+			allowedNamespaces[allowedNamespace] = true
+		}
+	}
+	log.Println("ALLOWED_NAMESPACES:", allowedNamespaces)
+
 	k3sClient, err := client.NewSK3sClient("/etc/secret-volume/config")
 	if err != nil {
 		log.Fatal("Error while initializing k3s client ::", err.Error())
 		return
 	}
 
-	edgeBalancer = balancer.NewBalancer(k3sClient, ownIP, "30090")
+	edgeClient = k3sClient
+	// other proxies reach the probe server through the node port of the probe port
+	probeNodePort := os.Getenv("PROBE_NODE_PORT")
+	if probeNodePort == "" {
+		probeNodePort = defaultProbeNodePort
+	}
+	log.Println("PROBE_NODE_PORT:", probeNodePort)
+
+	probeToken = os.Getenv("PROBE_TOKEN")
+	log.Println("PROBE_TOKEN set:", probeToken != "")
+
+	edgeBalancer = balancer.NewBalancer(k3sClient, ownIP, probeNodePort, probeToken)
+	edgeRouter = router.NewRouter()
+	edgeLimiter = limiter.NewLimiter()
+	edgeAdaptiveLimiter = newAdaptiveLimiter()
+	edgeRateLimiter = ratelimit.NewLimiter()
+	startRateLimitSync()
+
+	routesFile := os.Getenv("ROUTES_FILE")
+	log.Println("ROUTES_FILE:", routesFile)
+	if routesFile != "" {
+		rules, err := router.LoadRulesFile(routesFile)
+		if err != nil {
+			log.Fatal("Error while loading routes file ::", err.Error())
+			return
+		}
+		edgeRouter.SetRules(routesFile, rules)
+	}
+
+	routesCRD, err := strconv.ParseBool(os.Getenv("ROUTES_CRD"))
+	if err != nil {
+		routesCRD = false
+	}
+	log.Println("ROUTES_CRD:", routesCRD)
+	if routesCRD {
+		k3sClient.WatchRouteRules(edgeRouter.SetRules)
+	}
+
+	// optionally act as the controller for an ingress class and/or the HTTPRoutes of a gateway
+	ingressClass := os.Getenv("INGRESS_CLASS")
+	log.Println("INGRESS_CLASS:", ingressClass)
+	if ingressClass != "" {
+		k3sClient.WatchIngresses(ingressClass, edgeRouter.SetRules)
+	}
 
-	reverseProxy := http.HandlerFunc(reverseProxyHandler)
+	gatewayName := os.Getenv("GATEWAY_NAME")
+	log.Println("GATEWAY_NAME:", gatewayName)
+	gatewayNamespace := os.Getenv("GATEWAY_NAMESPACE")
+	if gatewayNamespace == "" {
+		gatewayNamespace = defaultNamespace
+	}
+	log.Println("GATEWAY_NAMESPACE:", gatewayNamespace)
+	if gatewayName != "" {
+		k3sClient.WatchHTTPRoutes(gatewayNamespace, gatewayName, edgeRouter.SetRules)
+	}
+
+	// additional listeners bound to a specific service port, e.g. LISTENER_PORTS="9091=metrics,9092=8080"
+	listenerPorts := parseListenerPorts(os.Getenv("LISTENER_PORTS"))
+	log.Println("LISTENER_PORTS:", listenerPorts)
+
+	for listenPort, servicePort := range listenerPorts {
+		serve(&http.Server{Addr: ":" + listenPort, Handler: h2c.NewHandler(newReverseProxyHandler(servicePort), &http2.Server{})}, "proxy for service port "+servicePort, false)
+	}
+
+	// L4 listeners bound to a service, e.g. STREAM_LISTENERS="mqtt:1883=iot/mqtt-broker,tcp:9000=sensors,udp:5683=coap-server"
+	streamListeners, err := stream.ParseListeners(os.Getenv("STREAM_LISTENERS"), defaultNamespace)
+	if err != nil {
+		log.Fatal("Error while parsing stream listeners ::", err.Error())
+		return
+	}
+	log.Println("STREAM_LISTENERS:", os.Getenv("STREAM_LISTENERS"))
+
+	if len(streamListeners) > 0 {
+		streamProxy := stream.NewProxy(edgeBalancer)
+		mqttProxy := mqtt.NewProxy(edgeBalancer, streamProxy)
+		coapProxy := coap.NewProxy(edgeBalancer)
+		for _, listener := range streamListeners {
+			var closer io.Closer
+			switch listener.Protocol {
+			case "mqtt":
+				closer, err = mqttProxy.Serve(listener)
+			case "coap":
+				closer, err = coapProxy.Serve(listener)
+			default:
+				closer, err = streamProxy.Serve(listener)
+			}
+			if err != nil {
+				log.Fatal("Error while starting stream listener ::", err.Error())
+			}
+			addListener(closer)
+		}
+		addSessions(streamProxy.Wait)
+		addSessions(mqttProxy.Wait)
+		addSessions(coapProxy.Wait)
+	}
+
+	// metrics and the endpoints of the peers are served on a separate port so they are not reachable through the proxy
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/metrics", metricsHandler)
+	adminMux.HandleFunc(rateLimitPath, rateLimitHandler)
+	adminMux.HandleFunc("/healthz", healthzHandler)
+	adminMux.HandleFunc("/readyz", readyzHandler)
+	serve(&http.Server{Addr: ":" + (*adminPort), Handler: adminMux}, "admin server", false)
+
+	probeMux := http.NewServeMux()
+	probeMux.HandleFunc(probePath, probeHandler)
+	serve(&http.Server{Addr: ":" + (*probePort), Handler: probeMux}, "probe server", false)
+
+	reverseProxy := newReverseProxyHandler("")
 
 	mux := http.NewServeMux()
 	mux.Handle("/", reverseProxy)
-	mux.HandleFunc("/echo", echoHandler)
 
-	log.Println("Starting proxy at port " + *port)
-	log.Fatal(http.ListenAndServe(":"+(*port), mux))
+	// HTTP/2 over TLS is negotiated with ALPN, cleartext HTTP/2 (h2c) is accepted next to HTTP/1.1
+	tlsEnabled, err := strconv.ParseBool(os.Getenv("TLS_ENABLED"))
+	if err != nil {
+		tlsEnabled = false
+	}
+	log.Println("TLS_ENABLED:", tlsEnabled)
+	if tlsEnabled {
+		startTLSProxy(k3sClient, mux, *tlsPort)
+	}
+
+	serve(&http.Server{Addr: ":" + (*port), Handler: h2c.NewHandler(mux, &http2.Server{})}, "proxy", false)
+
+	addShutdownHook(func() {
+		rateLimitScheduler.Stop()
+	})
+	addShutdownHook(edgeBalancer.Stop)
+	addShutdownHook(k3sClient.Stop)
+	waitForShutdown()
+}
+
+// startTLSProxy serves the proxy with TLS, certificates are selected by SNI from the TLS secrets matching
+// TLS_SECRET_SELECTOR and reloaded when the secrets change, TLS_CERT_FILE/TLS_KEY_FILE is the default certificate
+func startTLSProxy(k3sClient *client.K3sClient, handler http.Handler, tlsPort string) {
+	certStore := certs.NewStore()
+
+	tlsCertFile := os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("TLS_KEY_FILE")
+	log.Println("TLS_CERT_FILE:", tlsCertFile, "TLS_KEY_FILE:", tlsKeyFile)
+	if tlsCertFile != "" && tlsKeyFile != "" {
+		if err := certStore.LoadDefaultCertificate(tlsCertFile, tlsKeyFile); err != nil {
+			log.Fatal("Error while loading TLS certificate ::", err.Error())
+		}
+	}
+
+	tlsSecretNamespace := os.Getenv("TLS_SECRET_NAMESPACE")
+	if tlsSecretNamespace == "" {
+		tlsSecretNamespace = defaultNamespace
+	}
+	log.Println("TLS_SECRET_NAMESPACE:", tlsSecretNamespace)
+
+	tlsSecretSelector := os.Getenv("TLS_SECRET_SELECTOR")
+	if tlsSecretSelector == "" {
+		tlsSecretSelector = defaultTLSSecretSelector
+	}
+	log.Println("TLS_SECRET_SELECTOR:", tlsSecretSelector)
+
+	k3sClient.WatchSecrets(tlsSecretNamespace, tlsSecretSelector, "", func(source string, data map[string][]byte) {
+		if data == nil {
+			certStore.DeleteCertificate(source)
+			return
+		}
+		if err := certStore.SetCertificate(source, data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey]); err != nil {
+			log.Println("Invalid TLS secret", source, "::", err)
+			certStore.DeleteCertificate(source)
+		}
+	})
+
+	clientAuth, err := certs.ParseClientAuth(os.Getenv("TLS_CLIENT_AUTH"))
+	if err != nil {
+		log.Fatal("Error while parsing TLS_CLIENT_AUTH ::", err.Error())
+	}
+	log.Println("TLS_CLIENT_AUTH:", clientAuth)
+
+	// CA bundle to verify client certificates (mTLS), read from the ca.crt key of the secret
+	tlsClientCASecret := os.Getenv("TLS_CLIENT_CA_SECRET")
+	log.Println("TLS_CLIENT_CA_SECRET:", tlsClientCASecret)
+	if clientAuth != tls.NoClientCert && tlsClientCASecret == "" {
+		log.Fatal("TLS_CLIENT_AUTH verifies client certificates, but TLS_CLIENT_CA_SECRET is not set")
+	}
+	if tlsClientCASecret != "" {
+		k3sClient.WatchSecrets(tlsSecretNamespace, "", "metadata.name="+tlsClientCASecret, func(source string, data map[string][]byte) {
+			if data == nil {
+				log.Println("Client CA secret", source, "deleted, keeping the last CA bundle")
+				return
+			}
+			if err := certStore.SetClientCAs(data[caBundleKey]); err != nil {
+				log.Println("Invalid client CA secret", source, "::", err)
+			}
+		})
+	}
+
+	server := &http.Server{
+		Addr:      ":" + tlsPort,
+		Handler:   handler,
+		TLSConfig: certStore.TLSConfig(clientAuth),
+	}
+
+	serve(server, "TLS proxy", true)
+}
+
+func parseListenerPorts(value string) map[string]string {
+	listenerPorts := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		listenPort, servicePort, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || listenPort == "" || servicePort == "" {
+			continue
+		}
+
+		listenerPorts[listenPort] = servicePort
+	}
+
+	return listenerPorts
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const metricsContentType string = "text/plain; version=0.0.4; charset=utf-8"
+
+var breakerStateValues = map[string]float64{
+	"closed":    0,
+	"half-open": 1,
+	"open":      2,
+}
+
+// metricsHandler exposes the state of the proxy in the Prometheus text format
+func metricsHandler(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", metricsContentType)
+
+	inFlight := make(map[string]float64)
+	for podIP, count := range edgeBalancer.GetInFlightAll() {
+		inFlight[podIP] = float64(count)
+	}
+	writeGauge(rw, "qedgeproxy_pod_inflight_requests", "Requests in flight from the proxy to the pod.", "pod", inFlight)
+
+	queueDepth := make(map[string]float64)
+	for key, depth := range edgeLimiter.QueueDepth() {
+		queueDepth[key] = float64(depth)
+	}
+	writeGauge(rw, "qedgeproxy_queue_depth", "Requests waiting for a concurrency slot of the service or pod.", "key", queueDepth)
+
+	queueWaits := make(map[string]float64)
+	for serviceKey, queueWait := range edgeBalancer.GetQueueWaits() {
+		queueWaits[serviceKey] = float64(queueWait)
+	}
+	writeGauge(rw, "qedgeproxy_service_queue_wait_ms", "Average time requests to the service waited for a concurrency slot.", "service", queueWaits)
+
+	adaptiveLimits := make(map[string]float64)
+	for key, limit := range edgeAdaptiveLimiter.Limits() {
+		adaptiveLimits[key] = float64(limit)
+	}
+	writeGauge(rw, "qedgeproxy_pod_adaptive_limit", "Adaptive concurrency limit of the pod of a service.", "key", adaptiveLimits)
+
+	breakerStates := make(map[string]float64)
+	for key, state := range edgeBalancer.GetBreakerStates() {
+		breakerStates[key] = breakerStateValues[state]
+	}
+	writeGauge(rw, "qedgeproxy_breaker_state", "Circuit breakers of a service on a node that are half-open (1) or open (2).", "key", breakerStates)
+
+	ejectedHosts := make(map[string]float64)
+	for serviceKey, hosts := range edgeBalancer.GetEjectedHosts() {
+		ejectedHosts[serviceKey] = float64(len(hosts))
+	}
+	writeGauge(rw, "qedgeproxy_ejected_hosts", "Nodes ejected as outliers of the service.", "service", ejectedHosts)
+}
+
+// writeGauge writes a gauge with one label, the samples are sorted by label value
+func writeGauge(w io.Writer, name string, help string, label string, values map[string]float64) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+
+	labelValues := make([]string, 0, len(values))
+	for labelValue := range values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		_, _ = fmt.Fprintf(w, "%s{%s=%s} %s\n", name, label, strconv.Quote(labelValue), strconv.FormatFloat(values[labelValue], 'g', -1, 64))
+	}
+}
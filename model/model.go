@@ -4,11 +4,17 @@ import (
 	"time"
 )
 
+// ServiceKey identifies a service across namespaces, used to key the pod cache and the latency data
+func ServiceKey(namespace string, service string) string {
+	return namespace + "/" + service
+}
+
 type PodInfo struct {
 	Namespace string
 	Name      string
 	IP        string
 	HostIP    string
+	Ports     map[string]string
 }
 
 type NodeMetrics struct {
@@ -16,6 +22,12 @@ type NodeMetrics struct {
 	RamUsage float64
 }
 
+type NodeTopology struct {
+	Site   string
+	Zone   string
+	Region string
+}
+
 type HostData struct {
 	Latency          int
 	IsApproximated   bool
@@ -27,15 +39,46 @@ type HostData struct {
 type PingCache struct {
 	CacheTime time.Time
 	Latency   int
+	Probe     *ProbeResponse
+}
+
+// ProbeResponse is the answer of the probe server of a proxy, with the load of its node. QueueDepths holds the
+// requests waiting at the proxy by service key, QueueDepth their total.
+type ProbeResponse struct {
+	Node        string         `json:"node"`
+	CpuUsage    float64        `json:"cpuUsage"`
+	RamUsage    float64        `json:"ramUsage"`
+	QueueDepth  int            `json:"queueDepth"`
+	QueueDepths map[string]int `json:"queueDepths,omitempty"`
+	InFlight    int            `json:"inFlight"`
+}
+
+type ServicePort struct {
+	Name       string
+	Port       string
+	TargetPort string
 }
 
 type PodInfoCache struct {
 	Pods        []*PodInfo
 	Annotations map[string]string
-	TargetPort  string
+	Ports       []*ServicePort
 }
 
 type MaintainerData struct {
 	Channel         chan struct{}
 	LastRequestTime time.Time
 }
+
+type RouteRule struct {
+	Name          string            `json:"name"`
+	Host          string            `json:"host,omitempty"`
+	PathPrefix    string            `json:"pathPrefix,omitempty"`
+	ExactPath     bool              `json:"exactPath,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Namespace     string            `json:"namespace,omitempty"`
+	Service       string            `json:"service"`
+	Port          string            `json:"port,omitempty"`
+	StripPrefix   bool              `json:"stripPrefix,omitempty"`
+	RewritePrefix string            `json:"rewritePrefix,omitempty"`
+}
@@ -0,0 +1,326 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/balancer"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/stream"
+)
+
+const (
+	packetConnect  byte = 1
+	packetPingReq  byte = 12
+	packetPingResp byte = 13
+)
+
+const protocolLevel5 byte = 5
+const maxConnectPacketSize int = 256 * 1024
+const connectTimeout = 10 * time.Second
+
+type Proxy struct {
+	balancer    *balancer.Balancer
+	streamProxy *stream.Proxy
+
+	// client connections in progress
+	sessions stream.Sessions
+}
+
+type connectInfo struct {
+	protocolLevel byte
+	clientID      string
+}
+
+func NewProxy(edgeBalancer *balancer.Balancer, streamProxy *stream.Proxy) *Proxy {
+	return &Proxy{
+		balancer:    edgeBalancer,
+		streamProxy: streamProxy,
+	}
+}
+
+// Serve starts serving the listener, closing the returned listener stops taking new clients while the connected
+// ones go on, see Wait
+func (p *Proxy) Serve(listener *stream.ListenerConfig) (io.Closer, error) {
+	tcpListener, err := net.Listen("tcp", ":"+listener.Port)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Starting MQTT proxy at port", listener.Port, "for service", listener.Namespace+"/"+listener.Service)
+
+	go func() {
+		for {
+			clientConn, err := tcpListener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("MQTT proxy at port", listener.Port, "stopped ::", err)
+				}
+				return
+			}
+
+			if !p.sessions.Start() {
+				clientConn.Close()
+				continue
+			}
+			go func() {
+				defer p.sessions.Done()
+				p.handleConn(clientConn, listener)
+			}()
+		}
+	}()
+
+	return tcpListener, nil
+}
+
+// Wait waits until the client connections in progress ended, new ones are no longer started
+func (p *Proxy) Wait() {
+	p.sessions.Wait()
+}
+
+// handleConn reads the CONNECT packet to pick a broker pod for the client ID, then relays packets in both
+// directions, measuring PINGREQ/PINGRESP round trips as latency samples
+func (p *Proxy) handleConn(clientConn net.Conn, listener *stream.ListenerConfig) {
+	defer clientConn.Close()
+
+	clientReader := bufio.NewReader(clientConn)
+	_ = clientConn.SetReadDeadline(time.Now().Add(connectTimeout))
+	connectPacket, err := readConnectPacket(clientReader)
+	if err != nil {
+		log.Println("MQTT: Invalid CONNECT from", clientConn.RemoteAddr(), "::", err)
+		return
+	}
+	_ = clientConn.SetReadDeadline(time.Time{})
+
+	connect, err := parseConnect(connectPacket)
+	if err != nil {
+		log.Println("MQTT: Invalid CONNECT from", clientConn.RemoteAddr(), "::", err)
+		return
+	}
+	log.Println("MQTT: CONNECT from client", connect.clientID)
+
+	upstreamConn, hostIP := p.streamProxy.DialPod(listener.Namespace, listener.Service, listener.ServicePort, connect.clientID)
+	if upstreamConn == nil {
+		log.Println("MQTT: No broker reachable for client", connect.clientID)
+		_, _ = clientConn.Write(getServerUnavailableConnack(connect.protocolLevel))
+		return
+	}
+	defer upstreamConn.Close()
+
+	if _, err := upstreamConn.Write(connectPacket); err != nil {
+		log.Println("MQTT: Failed to forward CONNECT to broker ::", err)
+		p.balancer.SetReqFailed(hostIP, listener.Namespace, listener.Service)
+		return
+	}
+
+	// unix nanoseconds of the outstanding PINGREQ, 0 if there is none
+	var pingSent atomic.Int64
+
+	done := make(chan struct{})
+	go func() {
+		relayPackets(upstreamConn, clientReader, func(packetType byte) {
+			if packetType == packetPingReq {
+				pingSent.Store(time.Now().UnixNano())
+			}
+		})
+		stream.CloseWrite(upstreamConn)
+		close(done)
+	}()
+
+	result := relayPackets(clientConn, bufio.NewReader(upstreamConn), func(packetType byte) {
+		if packetType != packetPingResp {
+			return
+		}
+		if sent := pingSent.Swap(0); sent != 0 {
+			p.balancer.SetLatency(hostIP, int(time.Since(time.Unix(0, sent)).Milliseconds()), listener.Namespace, listener.Service)
+		}
+	})
+	clientConn.Close()
+	if result.ReadErr != nil && !errors.Is(result.ReadErr, net.ErrClosed) {
+		log.Println("MQTT: Connection to broker broke for client", connect.clientID, "::", result.ReadErr)
+		p.balancer.SetReqFailed(hostIP, listener.Namespace, listener.Service)
+	}
+
+	<-done
+}
+
+// relayPackets forwards whole MQTT packets from src to dst, calling onPacket with the type of each packet
+// before it is forwarded, the read and write errors are reported separately
+func relayPackets(dst io.Writer, src *bufio.Reader, onPacket func(packetType byte)) stream.CopyResult {
+	buffer := make([]byte, 32*1024)
+	for {
+		header, remainingLength, err := readFixedHeader(src)
+		if err == io.EOF {
+			return stream.CopyResult{}
+		}
+		if err != nil {
+			return stream.CopyResult{ReadErr: err}
+		}
+
+		onPacket(header[0] >> 4)
+
+		if _, err := dst.Write(header); err != nil {
+			return stream.CopyResult{WriteErr: err}
+		}
+		if result := copyPacketBody(dst, src, remainingLength, buffer); result.ReadErr != nil || result.WriteErr != nil {
+			return result
+		}
+	}
+}
+
+// copyPacketBody copies the remaining length of a packet in chunks, so a failed read of src is told apart from a
+// failed write to dst
+func copyPacketBody(dst io.Writer, src io.Reader, remainingLength int, buffer []byte) stream.CopyResult {
+	for remainingLength > 0 {
+		chunk := buffer
+		if remainingLength < len(chunk) {
+			chunk = chunk[:remainingLength]
+		}
+
+		n, readErr := src.Read(chunk)
+		if n > 0 {
+			if _, writeErr := dst.Write(chunk[:n]); writeErr != nil {
+				return stream.CopyResult{WriteErr: writeErr}
+			}
+			remainingLength -= n
+		}
+		if readErr == io.EOF && remainingLength > 0 {
+			return stream.CopyResult{ReadErr: io.ErrUnexpectedEOF}
+		}
+		if readErr != nil && readErr != io.EOF {
+			return stream.CopyResult{ReadErr: readErr}
+		}
+	}
+
+	return stream.CopyResult{}
+}
+
+// readFixedHeader reads the packet type byte and the variable length encoded remaining length
+func readFixedHeader(src *bufio.Reader) ([]byte, int, error) {
+	typeByte, err := src.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	header := []byte{typeByte}
+	remainingLength := 0
+	for multiplier := 1; ; multiplier *= 128 {
+		lengthByte, err := src.ReadByte()
+		if err != nil {
+			return nil, 0, err
+		}
+		header = append(header, lengthByte)
+
+		remainingLength += int(lengthByte&127) * multiplier
+		if lengthByte&128 == 0 {
+			break
+		}
+		if len(header) > 4 {
+			return nil, 0, fmt.Errorf("malformed remaining length")
+		}
+	}
+
+	return header, remainingLength, nil
+}
+
+func readConnectPacket(src *bufio.Reader) ([]byte, error) {
+	header, remainingLength, err := readFixedHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]>>4 != packetConnect {
+		return nil, fmt.Errorf("first packet has type %d", header[0]>>4)
+	}
+	if remainingLength > maxConnectPacketSize {
+		return nil, fmt.Errorf("CONNECT packet too large")
+	}
+
+	packet := make([]byte, len(header)+remainingLength)
+	copy(packet, header)
+	if _, err := io.ReadFull(src, packet[len(header):]); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// parseConnect reads the protocol level and the client ID from a CONNECT packet (MQTT 3.1, 3.1.1 and 5)
+func parseConnect(packet []byte) (*connectInfo, error) {
+	_, headerLength, err := decodeVarInt(packet[1:])
+	if err != nil {
+		return nil, err
+	}
+	body := packet[1+headerLength:]
+
+	protocolName, body, err := readString(body)
+	if err != nil {
+		return nil, err
+	}
+	if protocolName != "MQTT" && protocolName != "MQIsdp" {
+		return nil, fmt.Errorf("unknown protocol %q", protocolName)
+	}
+
+	// protocol level, connect flags and keep alive
+	if len(body) < 4 {
+		return nil, fmt.Errorf("CONNECT packet truncated")
+	}
+	protocolLevel := body[0]
+	body = body[4:]
+
+	if protocolLevel == protocolLevel5 {
+		propertiesLength, lengthSize, err := decodeVarInt(body)
+		if err != nil || len(body) < lengthSize+propertiesLength {
+			return nil, fmt.Errorf("CONNECT properties truncated")
+		}
+		body = body[lengthSize+propertiesLength:]
+	}
+
+	clientID, _, err := readString(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &connectInfo{protocolLevel: protocolLevel, clientID: clientID}, nil
+}
+
+func readString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, fmt.Errorf("string truncated")
+	}
+
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return "", nil, fmt.Errorf("string truncated")
+	}
+
+	return string(data[2 : 2+length]), data[2+length:], nil
+}
+
+func decodeVarInt(data []byte) (int, int, error) {
+	value := 0
+	multiplier := 1
+	for i := 0; i < len(data) && i < 4; i++ {
+		value += int(data[i]&127) * multiplier
+		if data[i]&128 == 0 {
+			return value, i + 1, nil
+		}
+		multiplier *= 128
+	}
+
+	return 0, 0, fmt.Errorf("malformed variable byte integer")
+}
+
+func getServerUnavailableConnack(protocolLevel byte) []byte {
+	if protocolLevel == protocolLevel5 {
+		// reason code 0x88 server unavailable, no properties
+		return []byte{0x20, 0x03, 0x00, 0x88, 0x00}
+	}
+
+	// return code 3 server unavailable
+	return []byte{0x20, 0x02, 0x00, 0x03}
+}
@@ -0,0 +1,282 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// connectPacket builds a CONNECT packet around a variable header and payload
+func connectPacket(body []byte) []byte {
+	packet := []byte{packetConnect << 4}
+	length := len(body)
+	for {
+		lengthByte := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			lengthByte |= 128
+		}
+		packet = append(packet, lengthByte)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...)
+}
+
+func mqttString(value string) []byte {
+	return append([]byte{byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestParseConnect(t *testing.T) {
+	// connect flags (clean session) and keep alive of 60 s
+	flags := []byte{0x02, 0x00, 0x3c}
+
+	tests := []struct {
+		name          string
+		packet        []byte
+		protocolLevel byte
+		clientID      string
+		wantErr       bool
+	}{
+		{
+			name:          "MQTT 3.1",
+			packet:        connectPacket(concat(mqttString("MQIsdp"), []byte{3}, flags, mqttString("sensor-1"))),
+			protocolLevel: 3,
+			clientID:      "sensor-1",
+		},
+		{
+			name:          "MQTT 3.1.1",
+			packet:        connectPacket(concat(mqttString("MQTT"), []byte{4}, flags, mqttString("sensor-2"))),
+			protocolLevel: 4,
+			clientID:      "sensor-2",
+		},
+		{
+			name:          "MQTT 3.1.1 empty client ID",
+			packet:        connectPacket(concat(mqttString("MQTT"), []byte{4}, flags, mqttString(""))),
+			protocolLevel: 4,
+			clientID:      "",
+		},
+		{
+			name:          "MQTT 5 without properties",
+			packet:        connectPacket(concat(mqttString("MQTT"), []byte{5}, flags, []byte{0}, mqttString("sensor-3"))),
+			protocolLevel: 5,
+			clientID:      "sensor-3",
+		},
+		{
+			// session expiry interval (0x11) and receive maximum (0x21)
+			name:          "MQTT 5 with properties",
+			packet:        connectPacket(concat(mqttString("MQTT"), []byte{5}, flags, []byte{8, 0x11, 0, 0, 0, 60, 0x21, 0, 10}, mqttString("sensor-4"))),
+			protocolLevel: 5,
+			clientID:      "sensor-4",
+		},
+		{
+			name:          "MQTT 5 with a long client ID",
+			packet:        connectPacket(concat(mqttString("MQTT"), []byte{5}, flags, []byte{0}, mqttString(string(bytes.Repeat([]byte("x"), 200))))),
+			protocolLevel: 5,
+			clientID:      string(bytes.Repeat([]byte("x"), 200)),
+		},
+		{
+			name:    "unknown protocol name",
+			packet:  connectPacket(concat(mqttString("HTTP"), []byte{4}, flags, mqttString("sensor"))),
+			wantErr: true,
+		},
+		{
+			name:    "truncated protocol name",
+			packet:  connectPacket([]byte{0, 4, 'M', 'Q'}),
+			wantErr: true,
+		},
+		{
+			name:    "truncated connect flags",
+			packet:  connectPacket(concat(mqttString("MQTT"), []byte{4, 0x02})),
+			wantErr: true,
+		},
+		{
+			name:    "truncated client ID",
+			packet:  connectPacket(concat(mqttString("MQTT"), []byte{4}, flags, []byte{0, 8, 's', 'e'})),
+			wantErr: true,
+		},
+		{
+			name:    "missing client ID",
+			packet:  connectPacket(concat(mqttString("MQTT"), []byte{4}, flags)),
+			wantErr: true,
+		},
+		{
+			name:    "MQTT 5 truncated properties",
+			packet:  connectPacket(concat(mqttString("MQTT"), []byte{5}, flags, []byte{8, 0x11, 0, 0})),
+			wantErr: true,
+		},
+		{
+			name:    "MQTT 5 malformed properties length",
+			packet:  connectPacket(concat(mqttString("MQTT"), []byte{5}, flags, []byte{0xff, 0xff, 0xff, 0xff, 0x01})),
+			wantErr: true,
+		},
+		{
+			name:    "malformed remaining length",
+			packet:  []byte{packetConnect << 4, 0xff, 0xff, 0xff, 0xff, 0x01},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connect, err := parseConnect(test.packet)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", connect)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if connect.protocolLevel != test.protocolLevel || connect.clientID != test.clientID {
+				t.Fatalf("got level %d client %q, want level %d client %q", connect.protocolLevel, connect.clientID, test.protocolLevel, test.clientID)
+			}
+		})
+	}
+}
+
+func TestReadConnectPacket(t *testing.T) {
+	valid := connectPacket(concat(mqttString("MQTT"), []byte{4, 0x02, 0x00, 0x3c}, mqttString("sensor")))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "complete packet", data: valid},
+		{name: "packet followed by another", data: concat(valid, []byte{packetPingReq << 4, 0})},
+		{name: "empty", data: nil, wantErr: true},
+		{name: "truncated remaining length", data: []byte{packetConnect << 4, 0x80}, wantErr: true},
+		{name: "truncated body", data: valid[:len(valid)-3], wantErr: true},
+		{name: "remaining length over four bytes", data: []byte{packetConnect << 4, 0x80, 0x80, 0x80, 0x80, 0x01}, wantErr: true},
+		{name: "not a CONNECT", data: []byte{packetPingReq << 4, 0}, wantErr: true},
+		{name: "too large", data: []byte{packetConnect << 4, 0xff, 0xff, 0xff, 0x7f}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet, err := readConnectPacket(bufio.NewReader(bytes.NewReader(test.data)))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d bytes", len(packet))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(packet, valid) {
+				t.Fatalf("got packet %x, want %x", packet, valid)
+			}
+		})
+	}
+}
+
+func TestDecodeVarInt(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		value   int
+		size    int
+		wantErr bool
+	}{
+		{name: "zero", data: []byte{0x00}, value: 0, size: 1},
+		{name: "one byte maximum", data: []byte{0x7f}, value: 127, size: 1},
+		{name: "two bytes", data: []byte{0x80, 0x01}, value: 128, size: 2},
+		{name: "four bytes maximum", data: []byte{0xff, 0xff, 0xff, 0x7f}, value: 268435455, size: 4},
+		{name: "trailing data", data: []byte{0x05, 0xff}, value: 5, size: 1},
+		{name: "empty", data: nil, wantErr: true},
+		{name: "truncated", data: []byte{0x80, 0x80}, wantErr: true},
+		{name: "five bytes", data: []byte{0x80, 0x80, 0x80, 0x80, 0x01}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, size, err := decodeVarInt(test.data)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", value)
+				}
+				return
+			}
+			if err != nil || value != test.value || size != test.size {
+				t.Fatalf("got %d (%d bytes, %v), want %d (%d bytes)", value, size, err, test.value, test.size)
+			}
+		})
+	}
+}
+
+// limitedWriter fails once more than limit bytes were written
+type limitedWriter struct {
+	buffer bytes.Buffer
+	limit  int
+}
+
+var errWriteBroken = errors.New("write broken")
+var errReadBroken = errors.New("read broken")
+
+func (w *limitedWriter) Write(data []byte) (int, error) {
+	if w.buffer.Len()+len(data) > w.limit {
+		n := w.limit - w.buffer.Len()
+		w.buffer.Write(data[:n])
+		return n, errWriteBroken
+	}
+
+	return w.buffer.Write(data)
+}
+
+func TestRelayPackets(t *testing.T) {
+	publish := concat([]byte{0x30, 7}, mqttString("a/b"), []byte("hi"))
+	pingReq := []byte{packetPingReq << 4, 0}
+	valid := concat(publish, pingReq)
+
+	tests := []struct {
+		name         string
+		src          io.Reader
+		writeLimit   int
+		wantReadErr  error
+		wantWriteErr bool
+		wantTypes    []byte
+		wantWritten  []byte
+	}{
+		{name: "whole packets", src: bytes.NewReader(valid), writeLimit: 1024, wantTypes: []byte{3, packetPingReq}, wantWritten: valid},
+		{name: "truncated body", src: bytes.NewReader(publish[:5]), writeLimit: 1024, wantReadErr: io.ErrUnexpectedEOF, wantTypes: []byte{3}, wantWritten: publish[:5]},
+		{name: "source broken mid-packet", src: io.MultiReader(bytes.NewReader(publish[:5]), iotest.ErrReader(errReadBroken)), writeLimit: 1024, wantReadErr: errReadBroken, wantTypes: []byte{3}, wantWritten: publish[:5]},
+		{name: "destination broken on the header", src: bytes.NewReader(valid), writeLimit: 1, wantWriteErr: true, wantTypes: []byte{3}, wantWritten: publish[:1]},
+		{name: "destination broken mid-packet", src: bytes.NewReader(valid), writeLimit: 5, wantWriteErr: true, wantTypes: []byte{3}, wantWritten: publish[:5]},
+		{name: "destination broken on the second packet", src: bytes.NewReader(valid), writeLimit: len(publish), wantWriteErr: true, wantTypes: []byte{3, packetPingReq}, wantWritten: publish},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dst := &limitedWriter{limit: test.writeLimit}
+			var types []byte
+			result := relayPackets(dst, bufio.NewReader(test.src), func(packetType byte) {
+				types = append(types, packetType)
+			})
+
+			if !errors.Is(result.ReadErr, test.wantReadErr) || (test.wantReadErr == nil && result.ReadErr != nil) {
+				t.Fatalf("got read error %v, want %v", result.ReadErr, test.wantReadErr)
+			}
+			if test.wantWriteErr != errors.Is(result.WriteErr, errWriteBroken) {
+				t.Fatalf("got write error %v, want one: %t", result.WriteErr, test.wantWriteErr)
+			}
+			if !bytes.Equal(types, test.wantTypes) {
+				t.Fatalf("got packet types %v, want %v", types, test.wantTypes)
+			}
+			if !bytes.Equal(dst.buffer.Bytes(), test.wantWritten) {
+				t.Fatalf("got written %x, want %x", dst.buffer.Bytes(), test.wantWritten)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+)
+
+const defaultProbeNodePort string = "30190"
+const probePath string = "/probe"
+
+var probeToken string
+
+// probeHandler answers the latency probes of the other proxies with the load of this node, requests without
+// the PROBE_TOKEN bearer token are rejected if it is set
+func probeHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if probeToken != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+probeToken)) != 1 {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	probe := &model.ProbeResponse{Node: ownIP}
+	if nodeStatus, err := edgeClient.GetNodesStatus(); err == nil && nodeStatus[ownIP] != nil {
+		probe.CpuUsage = nodeStatus[ownIP].CpuUsage
+		probe.RamUsage = nodeStatus[ownIP].RamUsage
+	}
+	probe.QueueDepths = make(map[string]int)
+	for key, depth := range edgeLimiter.QueueDepth() {
+		// limiter keys are namespace/service or namespace/service/podIP
+		parts := strings.SplitN(key, "/", 3)
+		if len(parts) >= 2 {
+			probe.QueueDepths[model.ServiceKey(parts[0], parts[1])] += depth
+		}
+		probe.QueueDepth += depth
+	}
+	for _, count := range edgeBalancer.GetInFlightAll() {
+		probe.InFlight += int(count)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(probe)
+}
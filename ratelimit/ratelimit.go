@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter holds a token bucket per key, the tokens taken since the last TakeConsumed are kept so they can
+// be shared with peers, which Deduct them from their own buckets
+type Limiter struct {
+	mutex    *sync.Mutex
+	buckets  map[string]*bucket
+	consumed map[string]float64
+}
+
+type bucket struct {
+	tokens     float64
+	rate       float64
+	burst      float64
+	lastRefill time.Time
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		mutex:    &sync.Mutex{},
+		buckets:  make(map[string]*bucket),
+		consumed: make(map[string]float64),
+	}
+}
+
+// Allow takes a token from the bucket of key, which holds up to burst tokens and refills with rate tokens per
+// second. If no token is left it returns false and the time until the next token.
+func (l *Limiter) Allow(key string, rate float64, burst float64) (bool, time.Duration) {
+	if rate <= 0 {
+		return true, 0
+	}
+	if burst < 1 {
+		burst = math.Max(rate, 1)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	b := l.buckets[key]
+	if b == nil {
+		// a new bucket starts full
+		b = &bucket{tokens: burst, lastRefill: now}
+		l.buckets[key] = b
+	}
+	b.rate = rate
+	b.burst = burst
+	b.refill(now)
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+
+	b.tokens--
+	l.consumed[key]++
+	return true, 0
+}
+
+// TakeConsumed returns the tokens taken by key since the last call
+func (l *Limiter) TakeConsumed() map[string]float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	consumed := l.consumed
+	l.consumed = make(map[string]float64)
+
+	return consumed
+}
+
+// Deduct takes the tokens consumed by peers from the buckets, a bucket owes at most one burst of tokens.
+// Keys without a bucket are ignored, peers can only drain the buckets of keys this proxy limits itself.
+func (l *Limiter) Deduct(consumed map[string]float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for key, tokens := range consumed {
+		b := l.buckets[key]
+		if b == nil || !(tokens > 0) {
+			continue
+		}
+
+		b.refill(now)
+		b.tokens = math.Max(b.tokens-tokens, -b.burst)
+	}
+}
+
+// RemoveIdle removes the buckets that were full or unused for longer than idle
+func (l *Limiter) RemoveIdle(idle time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for key, b := range l.buckets {
+		if now.Sub(b.lastRefill) < idle {
+			continue
+		}
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.tokens+now.Sub(b.lastRefill).Seconds()*b.rate, b.burst)
+	b.lastRefill = now
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/ratelimit"
+)
+
+const defaultClientKeyHeader string = "X-API-Key"
+const defaultRateLimitSyncS int = 1
+const rateLimitIdleTime = 10 * time.Minute
+const rateLimitPath string = "/ratelimit"
+const peerAdminPortName string = "admin"
+
+var edgeRateLimiter *ratelimit.Limiter
+var rateLimitScheduler *cron.Cron
+var rateLimitToken string
+var rateLimitClient = &http.Client{Timeout: 2 * time.Second}
+
+// checkRateLimits takes a token of the rateLimit bucket of the service and of the clientRateLimit bucket of
+// the client (service annotations), if a bucket is empty 429 is written with Retry-After
+func checkRateLimits(rw http.ResponseWriter, req *http.Request, namespace string, service string) bool {
+	serviceKey := model.ServiceKey(namespace, service)
+
+	allowed, retryAfter := edgeRateLimiter.Allow(serviceKey, getRateAnnotation(namespace, service, "rateLimit"), getRateAnnotation(namespace, service, "rateLimitBurst"))
+	if allowed {
+		clientRate := getRateAnnotation(namespace, service, "clientRateLimit")
+		if clientRate > 0 {
+			clientKey := getClientKey(req, namespace, service)
+			allowed, retryAfter = edgeRateLimiter.Allow(serviceKey+"/client/"+clientKey, clientRate, getRateAnnotation(namespace, service, "clientRateLimitBurst"))
+		}
+	}
+
+	if !allowed {
+		log.Println("Rate limit of service", serviceKey, "exceeded")
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Max(math.Ceil(retryAfter.Seconds()), 1))))
+		rw.WriteHeader(http.StatusTooManyRequests)
+		_, _ = fmt.Fprint(rw, "Rate limit exceeded\n")
+	}
+
+	return allowed
+}
+
+func getRateAnnotation(namespace string, service string, name string) float64 {
+	rate, err := strconv.ParseFloat(edgeBalancer.GetServiceAnnotation(namespace, service, name), 64)
+	if err != nil {
+		return 0
+	}
+
+	return rate
+}
+
+// getClientKey identifies the client with the clientKey annotation of the service: source-ip (default) or
+// header, the header named by clientKeyHeader which is X-API-Key by default, or the source IP without it
+func getClientKey(req *http.Request, namespace string, service string) string {
+	if edgeBalancer.GetServiceAnnotation(namespace, service, "clientKey") == "header" {
+		headerName := edgeBalancer.GetServiceAnnotation(namespace, service, "clientKeyHeader")
+		if headerName == "" {
+			headerName = defaultClientKeyHeader
+		}
+		// requests without the header would all share one bucket, they are told apart by source IP instead
+		if value := req.Header.Get(headerName); value != "" {
+			return "header/" + value
+		}
+	}
+
+	return "ip/" + getSourceIP(req)
+}
+
+// startRateLimitSync removes idle buckets and, if RATE_LIMIT_PEERS names the service of the proxy, sends the
+// tokens taken since the last sync to the other proxies every RATE_LIMIT_SYNC_S, so a client can't exceed a
+// limit by spreading its requests over the nodes. The proxy service is looked up in RATE_LIMIT_PEERS_NAMESPACE,
+// by default the namespace of the proxy. The proxies authenticate each other with RATE_LIMIT_TOKEN.
+func startRateLimitSync() {
+	peerService := os.Getenv("RATE_LIMIT_PEERS")
+	log.Println("RATE_LIMIT_PEERS:", peerService)
+
+	peerNamespace := os.Getenv("RATE_LIMIT_PEERS_NAMESPACE")
+	if peerNamespace == "" {
+		peerNamespace = os.Getenv("POD_NAMESPACE")
+	}
+	if peerNamespace == "" {
+		peerNamespace = defaultNamespace
+	}
+	log.Println("RATE_LIMIT_PEERS_NAMESPACE:", peerNamespace)
+
+	rateLimitToken = os.Getenv("RATE_LIMIT_TOKEN")
+	log.Println("RATE_LIMIT_TOKEN set:", rateLimitToken != "")
+	if peerService != "" && rateLimitToken == "" {
+		log.Println("RATE_LIMIT_PEERS is ignored without RATE_LIMIT_TOKEN")
+		peerService = ""
+	}
+
+	syncS, err := strconv.Atoi(os.Getenv("RATE_LIMIT_SYNC_S"))
+	if err != nil || syncS < 1 {
+		syncS = defaultRateLimitSyncS
+	}
+	log.Println("RATE_LIMIT_SYNC_S:", syncS)
+
+	rateLimitScheduler = cron.New(cron.WithSeconds())
+	_, _ = rateLimitScheduler.AddFunc("@every 60s", func() {
+		edgeRateLimiter.RemoveIdle(rateLimitIdleTime)
+	})
+	if peerService != "" {
+		_, _ = rateLimitScheduler.AddFunc(fmt.Sprintf("@every %ds", syncS), func() {
+			syncRateLimits(peerNamespace, peerService)
+		})
+	}
+	rateLimitScheduler.Start()
+}
+
+func syncRateLimits(peerNamespace string, peerService string) {
+	consumed := edgeRateLimiter.TakeConsumed()
+	if len(consumed) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(consumed)
+	if err != nil {
+		log.Println("Failed to encode rate limit counters ::", err)
+		return
+	}
+
+	peers, _, _, err := edgeClient.GetPodsForService(peerNamespace, peerService)
+	if err != nil {
+		log.Println("Failed to retrieve rate limit peers ::", err)
+		return
+	}
+
+	for _, peer := range peers {
+		adminPort, found := peer.Ports[peerAdminPortName]
+		if peer.HostIP == ownIP || !found {
+			continue
+		}
+
+		go func(peerURL string) {
+			req, err := http.NewRequest(http.MethodPost, peerURL, bytes.NewReader(body))
+			if err != nil {
+				log.Println("Failed to create rate limit request for", peerURL, "::", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+rateLimitToken)
+
+			resp, err := rateLimitClient.Do(req)
+			if err != nil {
+				log.Println("Failed to send rate limit counters to", peerURL, "::", err)
+				return
+			}
+			_ = resp.Body.Close()
+		}("http://" + peer.IP + ":" + adminPort + rateLimitPath)
+	}
+}
+
+// rateLimitHandler receives the tokens taken by a peer, requests without the RATE_LIMIT_TOKEN bearer token are
+// rejected and so are all requests if it is not set
+func rateLimitHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rateLimitToken == "" || subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+rateLimitToken)) != 1 {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	consumed := make(map[string]float64)
+	if err := json.NewDecoder(req.Body).Decode(&consumed); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	edgeRateLimiter.Deduct(consumed)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,179 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+	"sigs.k8s.io/yaml"
+)
+
+type Router struct {
+	mutex *sync.RWMutex
+
+	// rules are grouped by their source (config file, CRD object...) so a source can be replaced as a whole
+	sourceRules map[string][]*model.RouteRule
+	rules       []*model.RouteRule
+}
+
+type routesFile struct {
+	Routes []*model.RouteRule `json:"routes"`
+}
+
+func NewRouter() *Router {
+	return &Router{
+		mutex:       &sync.RWMutex{},
+		sourceRules: make(map[string][]*model.RouteRule),
+	}
+}
+
+// SetRules replaces all rules of a source, an empty list removes the source
+func (r *Router) SetRules(source string, rules []*model.RouteRule) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(rules) == 0 {
+		delete(r.sourceRules, source)
+	} else {
+		r.sourceRules[source] = rules
+	}
+
+	sortedRules := make([]*model.RouteRule, 0)
+	for _, sourceRules := range r.sourceRules {
+		sortedRules = append(sortedRules, sourceRules...)
+	}
+
+	// most specific rules first: exact hosts before wildcards, exact paths before prefixes, longer path prefixes and
+	// more header matches first
+	sort.SliceStable(sortedRules, func(i, j int) bool {
+		if hostRank(sortedRules[i].Host) != hostRank(sortedRules[j].Host) {
+			return hostRank(sortedRules[i].Host) > hostRank(sortedRules[j].Host)
+		}
+		if sortedRules[i].ExactPath != sortedRules[j].ExactPath {
+			return sortedRules[i].ExactPath
+		}
+		if len(sortedRules[i].PathPrefix) != len(sortedRules[j].PathPrefix) {
+			return len(sortedRules[i].PathPrefix) > len(sortedRules[j].PathPrefix)
+		}
+		if len(sortedRules[i].Headers) != len(sortedRules[j].Headers) {
+			return len(sortedRules[i].Headers) > len(sortedRules[j].Headers)
+		}
+		return sortedRules[i].Name < sortedRules[j].Name
+	})
+
+	r.rules = sortedRules
+	log.Println("Routing table updated from", source, "::", len(r.rules), "rules")
+}
+
+// Match returns the most specific rule matching the request or nil if none matches
+func (r *Router) Match(req *http.Request) *model.RouteRule {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	host := getHostname(req.Host)
+	for _, rule := range r.rules {
+		if matchHost(rule.Host, host) && matchPath(rule, req.URL.Path) && matchHeaders(rule.Headers, req.Header) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// RewritePath strips or rewrites the matched path prefix before the request is forwarded
+func RewritePath(req *http.Request, rule *model.RouteRule) {
+	if rule.PathPrefix == "" || (!rule.StripPrefix && rule.RewritePrefix == "") {
+		return
+	}
+
+	path := strings.TrimSuffix(rule.RewritePrefix, "/") + strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(rule.PathPrefix, "/"))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	req.URL.Path = path
+	req.URL.RawPath = ""
+}
+
+func LoadRulesFile(path string) ([]*model.RouteRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes routesFile
+	if err := yaml.Unmarshal(data, &routes); err != nil {
+		return nil, err
+	}
+
+	for index, rule := range routes.Routes {
+		if rule.Service == "" {
+			return nil, fmt.Errorf("route %d (%s) has no service", index, rule.Name)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%s-%d", path, index)
+		}
+	}
+
+	return routes.Routes, nil
+}
+
+func hostRank(pattern string) int {
+	if pattern == "" {
+		return 0
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return 1
+	}
+	return 2
+}
+
+func matchHost(pattern string, host string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(pattern[1:]))
+	}
+
+	return strings.EqualFold(pattern, host)
+}
+
+func matchPath(rule *model.RouteRule, path string) bool {
+	prefix := rule.PathPrefix
+	if rule.ExactPath {
+		return path == prefix
+	}
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+
+	// prefixes match whole path segments, /api matches /api and /api/v1 but not /apis
+	trimmedPrefix := strings.TrimSuffix(prefix, "/")
+	return path == trimmedPrefix || strings.HasPrefix(path, trimmedPrefix+"/")
+}
+
+func matchHeaders(headers map[string]string, requestHeaders http.Header) bool {
+	for name, value := range headers {
+		if requestHeaders.Get(name) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func getHostname(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+
+	return host
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultDrainDelayS int = 5
+const defaultDrainTimeoutS int = 20
+
+// draining is set on SIGTERM, the proxy is no longer ready but still serves the requests it gets
+var draining atomic.Bool
+
+var servers []*http.Server
+var registeredServers atomic.Int32
+var listeningServers atomic.Int32
+var shutdownHooks []func()
+
+// listeners and sessions of the L4 proxies, which are drained with the servers
+var listeners []io.Closer
+var sessionWaits []func()
+
+// serve starts the server and registers it to be drained on shutdown, it must be called before waitForShutdown
+func serve(server *http.Server, name string, tls bool) {
+	servers = append(servers, server)
+	registeredServers.Add(1)
+
+	go func() {
+		log.Println("Starting", name, "at", server.Addr)
+
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeningServers.Add(1)
+
+		if tls {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// addListener registers a listener of an L4 proxy to be closed on shutdown, like the servers
+func addListener(listener io.Closer) {
+	listeners = append(listeners, listener)
+}
+
+// addSessions registers a function waiting for the connections and flows of an L4 proxy, they are drained
+// together with the requests of the servers
+func addSessions(wait func()) {
+	sessionWaits = append(sessionWaits, wait)
+}
+
+// addShutdownHook registers a function that is called once the servers are drained, in registration order
+func addShutdownHook(hook func()) {
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT, fails readiness for DRAIN_DELAY_S so the proxy is taken out of
+// the endpoints, drains the servers and the L4 listeners for at most DRAIN_TIMEOUT_S and then runs the shutdown hooks
+func waitForShutdown() {
+	drainDelayS, err := strconv.Atoi(os.Getenv("DRAIN_DELAY_S"))
+	if err != nil {
+		drainDelayS = defaultDrainDelayS
+	}
+	log.Println("DRAIN_DELAY_S:", drainDelayS)
+
+	drainTimeoutS, err := strconv.Atoi(os.Getenv("DRAIN_TIMEOUT_S"))
+	if err != nil {
+		drainTimeoutS = defaultDrainTimeoutS
+	}
+	log.Println("DRAIN_TIMEOUT_S:", drainTimeoutS)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	log.Println("Received", <-signals, ", draining")
+
+	draining.Store(true)
+	for _, server := range servers {
+		server.SetKeepAlivesEnabled(false)
+	}
+	time.Sleep(time.Duration(drainDelayS) * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainTimeoutS)*time.Second)
+	defer cancel()
+
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Println("Failed to drain server at", server.Addr, "::", err)
+				_ = server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	sessionsDone := make(chan struct{})
+	go func() {
+		for _, wait := range sessionWaits {
+			wait()
+		}
+		close(sessionsDone)
+	}()
+	select {
+	case <-sessionsDone:
+	case <-ctx.Done():
+		log.Println("L4 connections still open after DRAIN_TIMEOUT_S")
+	}
+
+	// upgraded connections are hijacked from the servers, they are still counted as requests in flight
+	for len(edgeBalancer.GetInFlightAll()) > 0 && ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Println("Drained servers")
+
+	for _, hook := range shutdownHooks {
+		hook()
+	}
+	log.Println("Shutdown complete")
+}
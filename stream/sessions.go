@@ -0,0 +1,39 @@
+package stream
+
+import (
+	"sync"
+)
+
+// Sessions counts the connections and flows of a proxy in progress. Starting a session and the start of Wait are
+// serialized, so no session is added while Wait waits and none starts after it.
+type Sessions struct {
+	mutex   sync.Mutex
+	closing bool
+	group   sync.WaitGroup
+}
+
+// Start counts a new session, it returns false once Wait was called and the session must not be started
+func (s *Sessions) Start() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.group.Add(1)
+	return true
+}
+
+// Done counts a session started with Start as ended
+func (s *Sessions) Done() {
+	s.group.Done()
+}
+
+// Wait stops new sessions from starting and waits until those in progress ended
+func (s *Sessions) Wait() {
+	s.mutex.Lock()
+	s.closing = true
+	s.mutex.Unlock()
+
+	s.group.Wait()
+}
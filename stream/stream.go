@@ -0,0 +1,430 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/balancer"
+)
+
+const defaultDialTimeoutS int = 3
+const defaultUDPIdleTimeoutS int = 60
+const defaultDialAttempts int = 2
+const maxPendingDatagrams int = 16
+
+type ListenerConfig struct {
+	Protocol    string
+	Port        string
+	Namespace   string
+	Service     string
+	ServicePort string
+}
+
+type Proxy struct {
+	balancer *balancer.Balancer
+
+	dialTimeoutS    int
+	udpIdleTimeoutS int
+	dialAttempts    int
+
+	// connections and flows in progress
+	sessions Sessions
+}
+
+// udpListener is the socket of a UDP listener and the flows of its clients, once closed it takes no new
+// clients and flows end after being idle for the dial timeout, the socket stays open to answer them
+type udpListener struct {
+	conn         *net.UDPConn
+	flows        *sync.Map
+	closed       atomic.Bool
+	drainTimeout time.Duration
+}
+
+type udpFlow struct {
+	upstreamConn *net.UDPConn
+	hostIP       string
+	sentTime     time.Time
+	answered     bool
+	pending      [][]byte
+	mutex        *sync.Mutex
+}
+
+// Close stops taking new clients, the flows in progress are given the dial timeout to finish
+func (l *udpListener) Close() error {
+	l.closed.Store(true)
+	l.flows.Range(func(_, value any) bool {
+		flow := value.(*udpFlow)
+		flow.mutex.Lock()
+		if flow.upstreamConn != nil {
+			_ = flow.upstreamConn.SetReadDeadline(time.Now().Add(l.drainTimeout))
+		}
+		flow.mutex.Unlock()
+		return true
+	})
+
+	return nil
+}
+
+// CopyResult tells why a copy stopped, a read error means the source broke and a write error that the
+// destination went away, both are nil once the source is exhausted
+type CopyResult struct {
+	ReadErr  error
+	WriteErr error
+}
+
+func NewProxy(edgeBalancer *balancer.Balancer) *Proxy {
+	dialTimeoutS, err := strconv.Atoi(os.Getenv("STREAM_DIAL_TIMEOUT_S"))
+	if err != nil {
+		dialTimeoutS = defaultDialTimeoutS
+	}
+	log.Println("STREAM_DIAL_TIMEOUT_S:", dialTimeoutS)
+
+	udpIdleTimeoutS, err := strconv.Atoi(os.Getenv("UDP_IDLE_TIMEOUT_S"))
+	if err != nil {
+		udpIdleTimeoutS = defaultUDPIdleTimeoutS
+	}
+	log.Println("UDP_IDLE_TIMEOUT_S:", udpIdleTimeoutS)
+
+	dialAttempts, err := strconv.Atoi(os.Getenv("STREAM_DIAL_ATTEMPTS"))
+	if err != nil || dialAttempts < 1 {
+		dialAttempts = defaultDialAttempts
+	}
+	log.Println("STREAM_DIAL_ATTEMPTS:", dialAttempts)
+
+	return &Proxy{
+		balancer:        edgeBalancer,
+		dialTimeoutS:    dialTimeoutS,
+		udpIdleTimeoutS: udpIdleTimeoutS,
+		dialAttempts:    dialAttempts,
+	}
+}
+
+// ParseListeners parses listener definitions of the form protocol:port=[namespace/]service[:port],
+// e.g. "tcp:1883=iot/mqtt-broker:mqtt,udp:5683=coap-server", protocols other than tcp and udp are
+// served by protocol aware proxies
+func ParseListeners(value string, defaultNamespace string) ([]*ListenerConfig, error) {
+	listeners := make([]*ListenerConfig, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		listen, target, found := strings.Cut(entry, "=")
+		protocol, port, hasPort := strings.Cut(listen, ":")
+		if !found || !hasPort || protocol == "" {
+			return nil, fmt.Errorf("invalid stream listener %q", entry)
+		}
+
+		namespace := defaultNamespace
+		if ns, service, hasNamespace := strings.Cut(target, "/"); hasNamespace {
+			namespace = ns
+			target = service
+		}
+		service, servicePort, _ := strings.Cut(target, ":")
+		if service == "" {
+			return nil, fmt.Errorf("invalid stream listener %q", entry)
+		}
+
+		listeners = append(listeners, &ListenerConfig{
+			Protocol:    protocol,
+			Port:        port,
+			Namespace:   namespace,
+			Service:     service,
+			ServicePort: servicePort,
+		})
+	}
+
+	return listeners, nil
+}
+
+// Serve starts serving the listener, closing the returned listener stops taking new connections and flows
+// while those in progress go on, see Wait
+func (p *Proxy) Serve(listener *ListenerConfig) (io.Closer, error) {
+	switch listener.Protocol {
+	case "tcp":
+		return p.serveTCP(listener)
+	case "udp":
+		return p.serveUDP(listener)
+	}
+
+	return nil, fmt.Errorf("unsupported stream listener protocol %q", listener.Protocol)
+}
+
+// Wait waits until the connections and flows in progress ended, new ones are no longer started
+func (p *Proxy) Wait() {
+	p.sessions.Wait()
+}
+
+func (p *Proxy) serveTCP(listener *ListenerConfig) (io.Closer, error) {
+	tcpListener, err := net.Listen("tcp", ":"+listener.Port)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Starting TCP proxy at port", listener.Port, "for service", listener.Namespace+"/"+listener.Service)
+
+	go func() {
+		for {
+			clientConn, err := tcpListener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("TCP proxy at port", listener.Port, "stopped ::", err)
+				}
+				return
+			}
+
+			if !p.sessions.Start() {
+				clientConn.Close()
+				continue
+			}
+			go func() {
+				defer p.sessions.Done()
+				p.handleTCPConn(clientConn, listener)
+			}()
+		}
+	}()
+
+	return tcpListener, nil
+}
+
+func (p *Proxy) handleTCPConn(clientConn net.Conn, listener *ListenerConfig) {
+	defer clientConn.Close()
+
+	upstreamConn, hostIP := p.DialPod(listener.Namespace, listener.Service, listener.ServicePort, "")
+	if upstreamConn == nil {
+		log.Println("No pod reachable for TCP connection from", clientConn.RemoteAddr())
+		return
+	}
+	defer upstreamConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		Copy(upstreamConn, clientConn)
+		CloseWrite(upstreamConn)
+		close(done)
+	}()
+
+	result := Copy(clientConn, upstreamConn)
+	clientConn.Close()
+	if result.ReadErr != nil && !errors.Is(result.ReadErr, net.ErrClosed) {
+		log.Println("TCP connection to pod broke ::", result.ReadErr)
+		p.balancer.SetReqFailed(hostIP, listener.Namespace, listener.Service)
+	}
+
+	<-done
+}
+
+// DialPod opens a TCP connection to a pod chosen by the balancer for the key, the connection establishment time
+// is reported as latency and failed attempts as failures before another pod is tried
+func (p *Proxy) DialPod(namespace string, service string, servicePort string, key string) (net.Conn, string) {
+	for attempt := 0; attempt < p.dialAttempts; attempt++ {
+		podIP, hostIP, targetPort := p.balancer.ChoosePodForKey(namespace, service, servicePort, key)
+		if podIP == "" {
+			return nil, ""
+		}
+
+		start := time.Now()
+		upstreamConn, err := net.DialTimeout("tcp", net.JoinHostPort(podIP, targetPort), time.Duration(p.dialTimeoutS)*time.Second)
+		if err != nil {
+			log.Println("Failed to connect to pod", podIP, "::", err)
+			p.balancer.SetReqFailed(hostIP, namespace, service)
+			continue
+		}
+
+		p.balancer.SetLatency(hostIP, int(time.Since(start).Milliseconds()), namespace, service)
+		return upstreamConn, hostIP
+	}
+
+	return nil, ""
+}
+
+func (p *Proxy) serveUDP(listener *ListenerConfig) (io.Closer, error) {
+	listenAddr, err := net.ResolveUDPAddr("udp", ":"+listener.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	listenConn, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Starting UDP proxy at port", listener.Port, "for service", listener.Namespace+"/"+listener.Service)
+
+	udp := &udpListener{conn: listenConn, flows: &sync.Map{}, drainTimeout: time.Duration(p.dialTimeoutS) * time.Second}
+	go func() {
+		if err := p.readUDP(udp, listener); err != nil {
+			log.Println("UDP proxy at port", listener.Port, "stopped ::", err)
+		}
+	}()
+
+	return udp, nil
+}
+
+func (p *Proxy) readUDP(udp *udpListener, listener *ListenerConfig) error {
+	buffer := make([]byte, 64*1024)
+	for {
+		n, clientAddr, err := udp.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return err
+		}
+
+		flowData, found := udp.flows.Load(clientAddr.String())
+		if !found {
+			if udp.closed.Load() || !p.sessions.Start() {
+				continue
+			}
+
+			flowData = &udpFlow{mutex: &sync.Mutex{}}
+			udp.flows.Store(clientAddr.String(), flowData)
+			go func(flow *udpFlow) {
+				defer p.sessions.Done()
+				p.openUDPFlow(udp, clientAddr, flow, listener)
+			}(flowData.(*udpFlow))
+		}
+
+		// datagrams arriving while the flow is being opened are queued, beyond maxPendingDatagrams dropped
+		flow := flowData.(*udpFlow)
+		flow.mutex.Lock()
+		upstreamConn := flow.upstreamConn
+		if upstreamConn == nil {
+			if len(flow.pending) < maxPendingDatagrams {
+				flow.pending = append(flow.pending, append([]byte(nil), buffer[:n]...))
+			}
+			flow.mutex.Unlock()
+			continue
+		}
+		if !flow.answered && flow.sentTime.IsZero() {
+			flow.sentTime = time.Now()
+		}
+		flow.mutex.Unlock()
+
+		if _, err := upstreamConn.Write(buffer[:n]); err != nil {
+			log.Println("Failed to forward UDP datagram to pod ::", err)
+		}
+	}
+}
+
+// openUDPFlow chooses a pod for a new client off the read loop, forwards the datagrams queued in the meantime
+// and relays the answers
+func (p *Proxy) openUDPFlow(udp *udpListener, clientAddr *net.UDPAddr, flow *udpFlow, listener *ListenerConfig) {
+	upstreamConn, hostIP := p.dialUDP(listener)
+	if upstreamConn == nil {
+		udp.flows.Delete(clientAddr.String())
+		return
+	}
+
+	flow.mutex.Lock()
+	flow.upstreamConn = upstreamConn
+	flow.hostIP = hostIP
+	if len(flow.pending) > 0 {
+		flow.sentTime = time.Now()
+	}
+	for _, datagram := range flow.pending {
+		if _, err := upstreamConn.Write(datagram); err != nil {
+			log.Println("Failed to forward UDP datagram to pod ::", err)
+		}
+	}
+	flow.pending = nil
+	flow.mutex.Unlock()
+
+	p.readUDPFlow(udp, clientAddr, flow, listener)
+}
+
+func (p *Proxy) dialUDP(listener *ListenerConfig) (*net.UDPConn, string) {
+	podIP, hostIP, targetPort := p.balancer.ChoosePod(listener.Namespace, listener.Service, listener.ServicePort)
+	if podIP == "" {
+		return nil, ""
+	}
+
+	podAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(podIP, targetPort))
+	if err != nil {
+		log.Println("Invalid pod address ::", err)
+		return nil, ""
+	}
+
+	upstreamConn, err := net.DialUDP("udp", nil, podAddr)
+	if err != nil {
+		log.Println("Failed to open UDP flow to pod", podIP, "::", err)
+		p.balancer.SetReqFailed(hostIP, listener.Namespace, listener.Service)
+		return nil, ""
+	}
+
+	return upstreamConn, hostIP
+}
+
+// readUDPFlow relays datagrams from the pod back to the client, the round trip of the first datagram is
+// reported as latency and a socket error, e.g. an ICMP port unreachable, as a failure. Pods need not answer,
+// a flow without traffic from the pod expires silently.
+func (p *Proxy) readUDPFlow(udp *udpListener, clientAddr *net.UDPAddr, flow *udpFlow, listener *ListenerConfig) {
+	defer udp.flows.Delete(clientAddr.String())
+	defer flow.upstreamConn.Close()
+
+	buffer := make([]byte, 64*1024)
+	for {
+		timeout := time.Duration(p.udpIdleTimeoutS) * time.Second
+		if udp.closed.Load() {
+			timeout = udp.drainTimeout
+		}
+		_ = flow.upstreamConn.SetReadDeadline(time.Now().Add(timeout))
+
+		n, err := flow.upstreamConn.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if !(errors.As(err, &netErr) && netErr.Timeout()) {
+				log.Println("UDP flow to pod failed ::", err)
+				p.balancer.SetReqFailed(flow.hostIP, listener.Namespace, listener.Service)
+			}
+			return
+		}
+
+		flow.mutex.Lock()
+		if !flow.answered {
+			flow.answered = true
+			p.balancer.SetLatency(flow.hostIP, int(time.Since(flow.sentTime).Milliseconds()), listener.Namespace, listener.Service)
+		}
+		flow.mutex.Unlock()
+
+		if _, err := udp.conn.WriteToUDP(buffer[:n], clientAddr); err != nil {
+			log.Println("Failed to forward UDP datagram to client ::", err)
+		}
+	}
+}
+
+// Copy copies until src is exhausted, reporting the read and write errors separately
+// so that a broken upstream can be told apart from a client that went away
+func Copy(dst io.Writer, src io.Reader) CopyResult {
+	buffer := make([]byte, 32*1024)
+	for {
+		n, readErr := src.Read(buffer)
+		if n > 0 {
+			if _, writeErr := dst.Write(buffer[:n]); writeErr != nil {
+				return CopyResult{WriteErr: writeErr}
+			}
+		}
+		if readErr == io.EOF {
+			return CopyResult{}
+		}
+		if readErr != nil {
+			return CopyResult{ReadErr: readErr}
+		}
+	}
+}
+
+// CloseWrite half-closes TCP and TLS connections so the other direction can finish, other connections are closed
+func CloseWrite(conn net.Conn) {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = halfCloser.CloseWrite()
+		return
+	}
+
+	_ = conn.Close()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/model"
+	"golang.org/x/net/http2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	protocolHTTP = "http"
+	protocolH2C  = "h2c"
+	protocolH2   = "h2"
+)
+
+// gRPC status codes that mean the pod could not serve the call, other codes are application errors
+var grpcFailureCodes = map[string]bool{
+	"4":  true, // DEADLINE_EXCEEDED
+	"8":  true, // RESOURCE_EXHAUSTED
+	"13": true, // INTERNAL
+	"14": true, // UNAVAILABLE
+	"15": true, // DATA_LOSS
+}
+
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+var h2cClient = &http.Client{
+	Transport: &http2.Transport{
+		AllowHTTP: true,
+		// h2c uses prior knowledge HTTP/2 over a plain TCP connection
+		DialTLSContext: func(ctx context.Context, network string, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	},
+}
+
+// TLS clients per service, rebuilt when the secrets they were built from change
+var upstreamTLSClients = &sync.Map{}
+
+type upstreamTLSClient struct {
+	version string
+	client  *http.Client
+}
+
+// getUpstreamProtocol returns the protocol used towards the pods of a service, set with the upstreamProtocol
+// annotation (http, h2c or h2), gRPC calls default to h2c since gRPC requires HTTP/2
+func getUpstreamProtocol(req *http.Request, namespace string, service string) string {
+	protocol := edgeBalancer.GetServiceAnnotation(namespace, service, "upstreamProtocol")
+	switch protocol {
+	case protocolHTTP, protocolH2C, protocolH2:
+		return protocol
+	}
+
+	if isGrpcRequest(req) {
+		return protocolH2C
+	}
+
+	return protocolHTTP
+}
+
+// isUpstreamTLS reports whether the pods of a service are reached with TLS, h2 always uses TLS,
+// other protocols when the upstreamTLS annotation is set
+func isUpstreamTLS(namespace string, service string, protocol string) bool {
+	if protocol == protocolH2 {
+		return true
+	}
+
+	upstreamTLS, err := strconv.ParseBool(edgeBalancer.GetServiceAnnotation(namespace, service, "upstreamTLS"))
+	return err == nil && upstreamTLS
+}
+
+func getUpstreamScheme(upstreamTLS bool) string {
+	if upstreamTLS {
+		return "https"
+	}
+
+	return "http"
+}
+
+func getUpstreamClient(namespace string, service string, protocol string, upstreamTLS bool) (*http.Client, error) {
+	if upstreamTLS {
+		return getUpstreamTLSClient(namespace, service, protocol)
+	}
+
+	if protocol == protocolH2C {
+		return h2cClient, nil
+	}
+
+	return http.DefaultClient, nil
+}
+
+// getUpstreamTLSClient returns a client verifying the pods against the CA bundle of the upstreamCASecret annotation
+// (system roots if not set) and presenting the certificate of the upstreamClientCertSecret annotation (mTLS),
+// pod certificates are verified for the upstreamServerName annotation, service.namespace.svc by default
+func getUpstreamTLSClient(namespace string, service string, protocol string) (*http.Client, error) {
+	caSecretName := edgeBalancer.GetServiceAnnotation(namespace, service, "upstreamCASecret")
+	clientCertSecretName := edgeBalancer.GetServiceAnnotation(namespace, service, "upstreamClientCertSecret")
+	serverName := edgeBalancer.GetServiceAnnotation(namespace, service, "upstreamServerName")
+	if serverName == "" {
+		serverName = service + "." + namespace + ".svc"
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	version := protocol + "|" + serverName
+
+	if caSecretName != "" {
+		caSecret, err := edgeClient.GetSecret(namespace, caSecretName)
+		if err != nil {
+			return nil, err
+		}
+
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caSecret.Data[caBundleKey]) {
+			return nil, fmt.Errorf("no certificates found in CA secret %s", caSecretName)
+		}
+		tlsConfig.RootCAs = rootCAs
+		version += "|" + caSecret.ResourceVersion
+	}
+
+	if clientCertSecretName != "" {
+		clientCertSecret, err := edgeClient.GetSecret(namespace, clientCertSecretName)
+		if err != nil {
+			return nil, err
+		}
+
+		clientCertificate, err := tls.X509KeyPair(clientCertSecret.Data[corev1.TLSCertKey], clientCertSecret.Data[corev1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCertificate}
+		version += "|" + clientCertSecret.ResourceVersion
+	}
+
+	serviceKey := model.ServiceKey(namespace, service)
+	if cached, found := upstreamTLSClients.Load(serviceKey); found && cached.(*upstreamTLSClient).version == version {
+		return cached.(*upstreamTLSClient).client, nil
+	}
+
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: protocol != protocolHTTP,
+	}
+	if protocol == protocolHTTP {
+		// HTTP/1.1 only, an empty map disables HTTP/2 negotiation
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	if cached, found := upstreamTLSClients.Load(serviceKey); found {
+		cached.(*upstreamTLSClient).client.CloseIdleConnections()
+	}
+
+	log.Println("Built upstream TLS client for service", serviceKey)
+	tlsClient := &http.Client{Transport: transport}
+	upstreamTLSClients.Store(serviceKey, &upstreamTLSClient{version: version, client: tlsClient})
+
+	return tlsClient, nil
+}
+
+func isGrpcRequest(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// getGrpcStatus returns the grpc-status of a finished call, which is sent in the trailers or,
+// for trailers-only responses, in the headers
+func getGrpcStatus(response *http.Response) string {
+	if status := response.Trailer.Get("Grpc-Status"); status != "" {
+		return status
+	}
+
+	return response.Header.Get("Grpc-Status")
+}
+
+func writeResponse(rw http.ResponseWriter, response *http.Response) {
+	for _, header := range hopHeaders {
+		response.Header.Del(header)
+	}
+
+	copyHeader(rw.Header(), response.Header)
+	rw.WriteHeader(response.StatusCode)
+
+	// flush after every read so that streamed responses (gRPC streams, server-sent events) are not held back
+	flusher, _ := rw.(http.Flusher)
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := response.Body.Read(buffer)
+		if n > 0 {
+			if _, writeErr := rw.Write(buffer[:n]); writeErr != nil {
+				break
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Failed reading response body ::", err)
+			}
+			break
+		}
+	}
+
+	// trailers are only known once the body is read
+	for name, values := range response.Trailer {
+		for _, value := range values {
+			rw.Header().Add(http.TrailerPrefix+name, value)
+		}
+	}
+}
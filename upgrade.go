@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gitlab.tel.fer.hr/vjukanovic/k3s-custom-routing/stream"
+)
+
+const upgradeDialTimeout = 5 * time.Second
+
+// upgradeResponseTimeout bounds the wait for the response headers of the pod, the upgraded connection has no deadline
+const upgradeResponseTimeout = 10 * time.Second
+
+func isUpgradeRequest(req *http.Request) bool {
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return req.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+
+	return false
+}
+
+// proxyUpgrade forwards an Upgrade (e.g. WebSocket) request and streams both directions once the pod switches
+// protocols, the handshake time is reported as latency and a failed handshake or broken upstream connection as a
+// failure. The handshake also adjusts the adaptive limit of the pod.
+func proxyUpgrade(rw http.ResponseWriter, req *http.Request, originServerURL *url.URL, upstreamClient *http.Client, namespace string, service string, hostIP string) {
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(rw, "Connection upgrade not supported\n")
+		return
+	}
+
+	start := time.Now()
+	upstreamConn, err := dialUpgrade(originServerURL, upstreamClient)
+	if err != nil {
+		log.Println("Failed to connect to pod for upgrade ::", err)
+		observePodRequest(namespace, service, originServerURL.Hostname(), int(time.Since(start).Milliseconds()), true)
+		edgeBalancer.SetReqFailed(hostIP, namespace, service)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer upstreamConn.Close()
+
+	req.Host = originServerURL.Host
+	req.URL.Host = originServerURL.Host
+	req.URL.Scheme = originServerURL.Scheme
+	req.RequestURI = ""
+
+	upstreamReader := bufio.NewReader(upstreamConn)
+	_ = upstreamConn.SetDeadline(time.Now().Add(upgradeResponseTimeout))
+	if err = req.Write(upstreamConn); err == nil {
+		var upstreamResponse *http.Response
+		upstreamResponse, err = http.ReadResponse(upstreamReader, req)
+		if err == nil {
+			defer upstreamResponse.Body.Close()
+			latency := int(time.Since(start).Milliseconds())
+			observePodRequest(namespace, service, originServerURL.Hostname(), latency, false)
+			edgeBalancer.SetLatency(hostIP, latency, namespace, service)
+
+			if upstreamResponse.StatusCode != http.StatusSwitchingProtocols {
+				log.Println("Pod refused the upgrade with status", upstreamResponse.StatusCode)
+				copyHeader(rw.Header(), upstreamResponse.Header)
+				rw.WriteHeader(upstreamResponse.StatusCode)
+				_, _ = io.Copy(rw, upstreamResponse.Body)
+				return
+			}
+
+			_ = upstreamConn.SetDeadline(time.Time{})
+			// headers set by the proxy itself, e.g. an affinity cookie
+			copyHeader(upstreamResponse.Header, rw.Header())
+			streamUpgraded(hijacker, upstreamConn, upstreamReader, upstreamResponse, namespace, service, hostIP)
+			return
+		}
+	}
+
+	log.Println("Failed to upgrade connection to pod ::", err)
+	observePodRequest(namespace, service, originServerURL.Hostname(), int(time.Since(start).Milliseconds()), true)
+	edgeBalancer.SetReqFailed(hostIP, namespace, service)
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
+// dialUpgrade connects to the pod, with the TLS config of the upstream client for https (upgrades need HTTP/1.1)
+func dialUpgrade(originServerURL *url.URL, upstreamClient *http.Client) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: upgradeDialTimeout}
+	if originServerURL.Scheme != "https" {
+		return dialer.Dial("tcp", originServerURL.Host)
+	}
+
+	tlsConfig := &tls.Config{}
+	if transport, ok := upstreamClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{"http/1.1"}
+
+	return tls.DialWithDialer(dialer, "tcp", originServerURL.Host, tlsConfig)
+}
+
+func streamUpgraded(hijacker http.Hijacker, upstreamConn net.Conn, upstreamReader *bufio.Reader, upstreamResponse *http.Response, namespace string, service string, hostIP string) {
+	clientConn, clientBuffer, err := hijacker.Hijack()
+	if err != nil {
+		log.Println("Failed to hijack client connection ::", err)
+		return
+	}
+	defer clientConn.Close()
+
+	if err := upstreamResponse.Write(clientConn); err != nil {
+		log.Println("Failed to send upgrade response to client ::", err)
+		return
+	}
+
+	log.Println("Connection upgraded to", upstreamResponse.Header.Get("Upgrade"), "for service", service)
+
+	// both readers may already hold buffered bytes, so they are read instead of the raw connections
+	upstreamErr := make(chan error, 1)
+	go func() {
+		result := stream.Copy(upstreamConn, clientBuffer.Reader)
+		stream.CloseWrite(upstreamConn)
+		upstreamErr <- result.ReadErr
+	}()
+
+	result := stream.Copy(clientConn, upstreamReader)
+	// the pod is done, closing the client connection also ends the client to pod direction
+	clientConn.Close()
+	if result.ReadErr != nil && !isClosedError(result.ReadErr) {
+		log.Println("Upgraded connection to pod broke ::", result.ReadErr)
+		edgeBalancer.SetReqFailed(hostIP, namespace, service)
+	}
+
+	<-upstreamErr
+	log.Println("Upgraded connection closed for service", service)
+}
+
+func isClosedError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func copyHeader(dst http.Header, src http.Header) {
+	for name, values := range src {
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}